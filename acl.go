@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyPattern is a ~pattern rule, %R~ and %W~ restrict it to reads or writes
+type keyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+// aclUser is never modified once it's in the registry, ACL SETUSER builds a
+// changed copy and swaps it in so permission checks don't need a lock.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// sha256 of the passwords, hex encoded
+	passwords []string
+	commands  map[*commandSpec]bool
+	// overrides of commands for single subcommands, e.g. config|get
+	subcommands map[string]bool
+	// command rules since the last +@all or -@all, as shown by ACL LIST
+	commandRules []string
+	keys         []keyPattern
+	// pub/sub channel patterns, kept for when pub/sub commands exist
+	channels []string
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:         name,
+		commands:     make(map[*commandSpec]bool),
+		subcommands:  make(map[string]bool),
+		commandRules: []string{"-@all"},
+	}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.commands = make(map[*commandSpec]bool, len(u.commands))
+	for spec, allowed := range u.commands {
+		c.commands[spec] = allowed
+	}
+	c.subcommands = make(map[string]bool, len(u.subcommands))
+	for name, allowed := range u.subcommands {
+		c.subcommands[name] = allowed
+	}
+	c.commandRules = slices.Clone(u.commandRules)
+	c.keys = slices.Clone(u.keys)
+	c.channels = slices.Clone(u.channels)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword compares against every stored hash in constant time
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	ok := false
+	for _, stored := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// applyRule applies a single ACL SETUSER rule
+func (u *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case strings.HasPrefix(rule, ">"):
+		u.addPasswordHash(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		hash := rule[1:]
+		if len(hash) != sha256.Size*2 || strings.ToLower(hash) != hash || !isHexString(hash) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPasswordHash(hash)
+	case strings.HasPrefix(rule, "<"), strings.HasPrefix(rule, "!"):
+		hash := rule[1:]
+		if rule[0] == '<' {
+			hash = hashPassword(rule[1:])
+		}
+		i := slices.Index(u.passwords, hash)
+		if i < 0 {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		u.passwords = slices.Delete(u.passwords, i, i+1)
+	case lower == "allkeys":
+		u.keys = []keyPattern{{pattern: "*", read: true, write: true}}
+	case lower == "resetkeys":
+		u.keys = nil
+	case strings.HasPrefix(rule, "~"):
+		u.keys = append(u.keys, keyPattern{pattern: rule[1:], read: true, write: true})
+	case strings.HasPrefix(rule, "%"):
+		selector, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || selector == "" {
+			return errors.New("Syntax error")
+		}
+		kp := keyPattern{pattern: pattern}
+		for _, c := range strings.ToUpper(selector) {
+			switch c {
+			case 'R':
+				kp.read = true
+			case 'W':
+				kp.write = true
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		u.keys = append(u.keys, kp)
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case strings.HasPrefix(rule, "&"):
+		u.channels = append(u.channels, rule[1:])
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(rule[0] == '+', lower[1:])
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.applyRule(r)
+		}
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPasswordHash(hash string) {
+	u.nopass = false
+	if !slices.Contains(u.passwords, hash) {
+		u.passwords = append(u.passwords, hash)
+	}
+}
+
+func isHexString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isHex(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyCommandRule handles +cmd, -cmd, +cmd|sub and +@category
+func (u *aclUser) applyCommandRule(allow bool, name string) error {
+	if category, ok := strings.CutPrefix(name, "@"); ok {
+		bits := aclCategoryBits(category)
+		if bits == 0 {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		for _, spec := range commandTable {
+			if spec.acl&bits != 0 {
+				u.setCommand(spec, allow)
+			}
+		}
+		for sub, acl := range subcommandACL {
+			if acl&bits != 0 {
+				u.subcommands[sub] = allow
+			}
+		}
+		if category == "all" {
+			u.commandRules = nil
+		}
+	} else if cmd, sub, ok := strings.Cut(name, "|"); ok {
+		spec := lookupCommand(strings.ToUpper(cmd))
+		if spec == nil || spec.flags&cmdContainer == 0 || sub == "" {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		u.subcommands[name] = allow
+	} else {
+		spec := lookupCommand(strings.ToUpper(name))
+		if spec == nil {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		u.setCommand(spec, allow)
+	}
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+	u.commandRules = append(u.commandRules, sign+name)
+	return nil
+}
+
+// setCommand allows or denies a command and every one of its subcommands
+func (u *aclUser) setCommand(spec *commandSpec, allow bool) {
+	u.commands[spec] = allow
+	for sub := range u.subcommands {
+		if strings.HasPrefix(sub, spec.name+"|") {
+			delete(u.subcommands, sub)
+		}
+	}
+}
+
+// aclCategoryBits returns the bit of a category name, every bit for "all"
+// and 0 for an unknown category
+func aclCategoryBits(name string) int {
+	if name == "all" {
+		return 1<<len(aclCategoryNames) - 1
+	}
+	if i := slices.Index(aclCategoryNames, name); i >= 0 {
+		return 1 << i
+	}
+	return 0
+}
+
+// aclDenial explains why a user can't run a command
+type aclDenial struct {
+	// "command" or "key"
+	reason string
+	// the command or key that was denied
+	object string
+}
+
+func (d *aclDenial) message(username string) string {
+	if d.reason == "key" {
+		return "No permissions to access a key"
+	}
+	return fmt.Sprintf("User %s has no permissions to run the '%s' command", username, d.object)
+}
+
+// check returns why the user may not run the command, or nil if it may
+func (u *aclUser) check(spec *commandSpec, input Value) *aclDenial {
+	if spec == nil {
+		// unknown commands get their own error when they run
+		return nil
+	}
+	full := commandFullName(spec, input)
+	allowed, ok := u.subcommands[full]
+	if !ok {
+		allowed = u.commands[spec]
+	}
+	if !allowed {
+		return &aclDenial{reason: "command", object: full}
+	}
+	for _, key := range spec.keys(input.array) {
+		if !u.canAccessKey(key, spec.isWrite()) {
+			return &aclDenial{reason: "key", object: key}
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) canAccessKey(key string, write bool) bool {
+	for _, kp := range u.keys {
+		if (write && !kp.write) || (!write && !kp.read) {
+			continue
+		}
+		if globMatch(kp.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe formats the user as an ACL LIST line, which is also the ACL
+// file format
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	parts = append(parts, u.flags()...)
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.describeChannels(), u.describeCommands())
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) describeKeys() string {
+	patterns := make([]string, len(u.keys))
+	for i, kp := range u.keys {
+		switch {
+		case kp.read && kp.write:
+			patterns[i] = "~" + kp.pattern
+		case kp.read:
+			patterns[i] = "%R~" + kp.pattern
+		default:
+			patterns[i] = "%W~" + kp.pattern
+		}
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (u *aclUser) describeChannels() string {
+	if len(u.channels) == 0 {
+		return "resetchannels"
+	}
+	patterns := make([]string, len(u.channels))
+	for i, channel := range u.channels {
+		patterns[i] = "&" + channel
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (u *aclUser) describeCommands() string {
+	if len(u.commandRules) == 0 {
+		return "+@all"
+	}
+	return strings.Join(u.commandRules, " ")
+}
+
+// aclRegistry holds the users by name
+type aclRegistry struct {
+	lock  sync.RWMutex
+	users map[string]*aclUser
+}
+
+func newDefaultACLUser() *aclUser {
+	u := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "+@all"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+func newACLRegistry() *aclRegistry {
+	return &aclRegistry{users: map[string]*aclUser{"default": newDefaultACLUser()}}
+}
+
+func (r *aclRegistry) user(name string) *aclUser {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.users[name]
+}
+
+// usernames returns the user names sorted
+func (r *aclRegistry) usernames() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.users))
+	for name := range r.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setUser applies rules to a copy of the user, creating it if needed, and
+// stores it only if every rule was valid
+func (r *aclRegistry) setUser(name string, rules []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var u *aclUser
+	if existing := r.users[name]; existing != nil {
+		u = existing.clone()
+	} else {
+		u = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %w", rule, err)
+		}
+	}
+	r.users[name] = u
+	return nil
+}
+
+// setDefaultPassword applies requirepass to the default user
+func (r *aclRegistry) setDefaultPassword(password string) {
+	rules := []string{"nopass"}
+	if password != "" {
+		rules = []string{"resetpass", ">" + password}
+	}
+	r.setUser("default", rules)
+}
+
+// autoAuthenticates reports whether new connections are logged in as the
+// default user without AUTH
+func (r *aclRegistry) autoAuthenticates() bool {
+	u := r.user("default")
+	return u.enabled && u.nopass
+}
+
+// authenticate returns the user if the credentials are valid
+func (r *aclRegistry) authenticate(name, password string) *aclUser {
+	u := r.user(name)
+	if u == nil || !u.enabled || !u.checkPassword(password) {
+		return nil
+	}
+	return u
+}
+
+// loadACLFile reads users in ACL LIST format. The default user is created
+// if the file doesn't define it.
+func loadACLFile(filename string) (map[string]*aclUser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil || len(args) < 2 || args[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: should start with user keyword followed by a user name", filename, lineNum)
+		}
+		name := args[1]
+		if users[name] != nil {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", filename, lineNum, name)
+		}
+		u := newACLUser(name)
+		for _, rule := range args[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: error in user declaration '%s': %v", filename, lineNum, rule, err)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if users["default"] == nil {
+		users["default"] = newDefaultACLUser()
+	}
+	return users, nil
+}
+
+// load replaces every user with the ones from the ACL file
+func (r *aclRegistry) load(filename string) error {
+	users, err := loadACLFile(filename)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.users = users
+	r.lock.Unlock()
+	return nil
+}
+
+// save writes the users to the ACL file through a temporary file
+func (r *aclRegistry) save(filename string) error {
+	var sb strings.Builder
+	for _, name := range r.usernames() {
+		if u := r.user(name); u != nil {
+			sb.WriteString(u.describe())
+			sb.WriteByte('\n')
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".acl-save-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// checkACL rejects commands the client's user isn't allowed to run
+func (e *Executor) checkACL(spec *commandSpec, input Value) Value {
+	if e.server == nil || e.client == nil || spec.allowedBeforeAuth() {
+		return Value{}
+	}
+	username := e.client.userName()
+	u := e.server.acl.user(username)
+	if u == nil {
+		return Value{typ: "error", str: fmt.Sprintf("NOPERM User %s no longer exists", username)}
+	}
+	if denial := u.check(spec, input); denial != nil {
+		e.recordACLDenial(denial.reason, denial.object, username)
+		return Value{typ: "error", str: "NOPERM " + denial.message(username)}
+	}
+	return Value{}
+}
+
+func (e *Executor) handleACLCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl' command"}
+	}
+	if e.server == nil {
+		return Value{typ: "error", str: "ERR ACL is not available"}
+	}
+	acl := e.server.acl
+	subcommand := strings.ToUpper(array[0].bulk)
+	args := array[1:]
+	wrongArgs := Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for 'acl|%s' command", strings.ToLower(subcommand))}
+	switch subcommand {
+	case "WHOAMI":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		if e.client == nil {
+			return Value{typ: "bulk", bulk: "default"}
+		}
+		return Value{typ: "bulk", bulk: e.client.userName()}
+	case "USERS":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		res := Value{typ: "array", array: []Value{}}
+		for _, name := range acl.usernames() {
+			res.array = append(res.array, Value{typ: "bulk", bulk: name})
+		}
+		return res
+	case "LIST":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		res := Value{typ: "array", array: []Value{}}
+		for _, name := range acl.usernames() {
+			if u := acl.user(name); u != nil {
+				res.array = append(res.array, Value{typ: "bulk", bulk: u.describe()})
+			}
+		}
+		return res
+	case "SETUSER":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		rules := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			rules[i] = arg.bulk
+		}
+		if err := acl.setUser(args[0].bulk, rules); err != nil {
+			return Value{typ: "error", str: "ERR " + err.Error()}
+		}
+		return Value{typ: "string", str: "OK"}
+	case "GETUSER":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		u := acl.user(args[0].bulk)
+		if u == nil {
+			return Value{typ: "null"}
+		}
+		return u.marshal()
+	case "DELUSER":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		deleted := 0
+		for _, arg := range args {
+			if arg.bulk == "default" {
+				return Value{typ: "error", str: "ERR The 'default' user cannot be removed"}
+			}
+		}
+		acl.lock.Lock()
+		for _, arg := range args {
+			if _, ok := acl.users[arg.bulk]; ok {
+				delete(acl.users, arg.bulk)
+				deleted++
+			}
+		}
+		acl.lock.Unlock()
+		e.server.killDeletedUsers(e.client)
+		return Value{typ: "integer", num: deleted}
+	case "CAT":
+		if len(args) > 1 {
+			return wrongArgs
+		}
+		res := Value{typ: "array", array: []Value{}}
+		if len(args) == 0 {
+			for _, name := range aclCategoryNames {
+				res.array = append(res.array, Value{typ: "bulk", bulk: name})
+			}
+			return res
+		}
+		bits := aclCategoryBits(strings.ToLower(args[0].bulk))
+		if bits == 0 {
+			return Value{typ: "error", str: fmt.Sprintf("ERR Unknown category '%s'", args[0].bulk)}
+		}
+		var names []string
+		for _, spec := range commandTable {
+			if spec.acl&bits != 0 {
+				names = append(names, spec.name)
+			}
+		}
+		for sub, acl := range subcommandACL {
+			if acl&bits != 0 {
+				names = append(names, sub)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			res.array = append(res.array, Value{typ: "bulk", bulk: name})
+		}
+		return res
+	case "DRYRUN":
+		if len(args) < 2 {
+			return wrongArgs
+		}
+		u := acl.user(args[0].bulk)
+		if u == nil {
+			return Value{typ: "error", str: fmt.Sprintf("ERR User '%s' not found", args[0].bulk)}
+		}
+		spec := lookupCommand(strings.ToUpper(args[1].bulk))
+		if spec == nil {
+			return Value{typ: "error", str: fmt.Sprintf("ERR Command '%s' not found", args[1].bulk)}
+		}
+		if denial := u.check(spec, Value{typ: "array", array: args[1:]}); denial != nil {
+			return Value{typ: "bulk", bulk: denial.message(u.name)}
+		}
+		return Value{typ: "string", str: "OK"}
+	case "LOG":
+		return e.handleACLLog(args)
+	case "LOAD", "SAVE":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		e.server.config.lock.RLock()
+		aclfile := e.server.config.aclfile
+		e.server.config.lock.RUnlock()
+		if aclfile == "" {
+			return Value{typ: "error", str: "ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."}
+		}
+		if subcommand == "SAVE" {
+			if err := acl.save(aclfile); err != nil {
+				return Value{typ: "error", str: "ERR There was an error trying to save the ACLs. Please check the server logs for more information"}
+			}
+			return Value{typ: "string", str: "OK"}
+		}
+		if err := acl.load(aclfile); err != nil {
+			return Value{typ: "error", str: "ERR " + err.Error()}
+		}
+		e.server.killDeletedUsers(e.client)
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", array[0].bulk)}
+	}
+}
+
+// marshal builds the ACL GETUSER reply
+func (u *aclUser) marshal() Value {
+	bulks := func(items []string) Value {
+		v := Value{typ: "array", array: []Value{}}
+		for _, item := range items {
+			v.array = append(v.array, Value{typ: "bulk", bulk: item})
+		}
+		return v
+	}
+	channels := u.describeChannels()
+	if len(u.channels) == 0 {
+		channels = ""
+	}
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "flags"}, bulks(u.flags()),
+		{typ: "bulk", bulk: "passwords"}, bulks(u.passwords),
+		{typ: "bulk", bulk: "commands"}, {typ: "bulk", bulk: u.describeCommands()},
+		{typ: "bulk", bulk: "keys"}, {typ: "bulk", bulk: u.describeKeys()},
+		{typ: "bulk", bulk: "channels"}, {typ: "bulk", bulk: channels},
+		{typ: "bulk", bulk: "selectors"}, {typ: "array", array: []Value{}},
+	}}
+}
+
+// killDeletedUsers disconnects clients authenticated as users that no
+// longer exist. The calling client is closed after its reply.
+func (s *Server) killDeletedUsers(self *Client) {
+	for _, c := range s.clients.list() {
+		if s.acl.user(c.userName()) != nil {
+			continue
+		}
+		if c == self {
+			c.closeAfterReply.Store(true)
+			continue
+		}
+		c.close()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACLSetUserRules(t *testing.T) {
+	u := newACLUser("alice")
+	for _, rule := range []string{"on", ">pw", "%R~cache:*", "~app:*", "+@read", "-keys", "+client|id"} {
+		if err := u.applyRule(rule); err != nil {
+			t.Fatalf("Failed to apply %q: %v", rule, err)
+		}
+	}
+	cases := []struct {
+		args   []string
+		denied string
+	}{
+		{[]string{"GET", "app:1"}, ""},
+		{[]string{"GET", "cache:1"}, ""},
+		{[]string{"GET", "other"}, "key"},
+		{[]string{"SET", "cache:1", "v"}, "command"},
+		{[]string{"KEYS", "*"}, "command"},
+		{[]string{"CLIENT", "ID"}, ""},
+		{[]string{"CLIENT", "LIST"}, "command"},
+	}
+	for _, c := range cases {
+		spec := lookupCommand(c.args[0])
+		denial := u.check(spec, command(c.args...))
+		if (denial == nil) != (c.denied == "") || (denial != nil && denial.reason != c.denied) {
+			t.Errorf("%v: expected denial %q, got %+v", c.args, c.denied, denial)
+		}
+	}
+
+	u.applyRule("+@write")
+	if denial := u.check(lookupCommand("SET"), command("SET", "cache:1", "v")); denial == nil || denial.reason != "key" {
+		t.Errorf("Expected writes to read-only keys to be denied, got %+v", denial)
+	}
+
+	for _, rule := range []string{"bogus", "+nosuchcommand", "+@nosuchcategory", "#abc", "<missing", "%X~k"} {
+		if err := u.applyRule(rule); err == nil {
+			t.Errorf("Expected %q to be rejected", rule)
+		}
+	}
+
+	want := "user alice on #" + hashPassword("pw") + " %R~cache:* ~app:* resetchannels -@all +@read -keys +client|id +@write"
+	if got := u.describe(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestACLCommands(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+
+	if res := admin.do(t, "ACL", "SETUSER", "reader", "on", ">pw", "~*", "+get", "+acl|whoami"); res.str != "OK" {
+		t.Fatalf("Expected ACL SETUSER to succeed, got %v", res)
+	}
+	if res := admin.do(t, "ACL", "SETUSER", "reader", "+bogus"); res.typ != "error" || !strings.Contains(res.str, "'+bogus'") {
+		t.Errorf("Expected an invalid rule to be rejected, got %v", res)
+	}
+	if res := admin.do(t, "ACL", "USERS"); len(res.array) != 2 || res.array[1].bulk != "reader" {
+		t.Errorf("Expected default and reader, got %v", res)
+	}
+	if res := admin.do(t, "ACL", "DRYRUN", "reader", "SET", "k", "v"); res.typ != "bulk" || !strings.Contains(res.bulk, "'set'") {
+		t.Errorf("Expected DRYRUN to deny SET, got %v", res)
+	}
+
+	reader := dialTestServer(t, server)
+	if res := reader.do(t, "AUTH", "reader", "pw"); res.str != "OK" {
+		t.Fatalf("Expected AUTH reader to succeed, got %v", res)
+	}
+	if res := reader.do(t, "ACL", "WHOAMI"); res.bulk != "reader" {
+		t.Errorf("Expected reader, got %v", res)
+	}
+	if res := reader.do(t, "GET", "k"); res.typ != "null" {
+		t.Errorf("Expected GET to be allowed, got %v", res)
+	}
+	if res := reader.do(t, "SET", "k", "v"); res.typ != "error" || !strings.HasPrefix(res.str, "NOPERM") {
+		t.Errorf("Expected NOPERM for SET, got %v", res)
+	}
+
+	if res := admin.do(t, "ACL", "DELUSER", "default"); res.typ != "error" {
+		t.Errorf("Expected the default user to be undeletable, got %v", res)
+	}
+	if res := admin.do(t, "ACL", "DELUSER", "reader"); res.num != 1 {
+		t.Errorf("Expected one deleted user, got %v", res)
+	}
+	if _, err := reader.parser.readResp(); err == nil {
+		t.Errorf("Expected clients of a deleted user to be disconnected")
+	}
+}
+
+func TestACLKeyPatterns(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+	// ~* covers every key, '/' included
+	if res := admin.do(t, "SET", "a/b", "x"); res.str != "OK" {
+		t.Errorf("Expected the default user to write a/b, got %v", res)
+	}
+
+	admin.do(t, "ACL", "SETUSER", "app", "on", ">pw", "~user:[0-9]*", "~tmp/[^x]?", "+@all")
+	app := dialTestServer(t, server)
+	app.do(t, "AUTH", "app", "pw")
+	for key, allowed := range map[string]bool{
+		"user:1":      true,
+		"user:42/bio": true,
+		"user:x":      false,
+		"tmp/ab":      true,
+		"tmp/xb":      false,
+		"tmp/abc":     false,
+	} {
+		res := app.do(t, "GET", key)
+		if denied := res.typ == "error" && strings.HasPrefix(res.str, "NOPERM"); denied == allowed {
+			t.Errorf("Expected access to %q to be %v, got %v", key, allowed, res)
+		}
+	}
+
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"a*b*c", "a/x/b/y/d", false},
+		{"[a-c]x", "bx", true},
+		{"[c-a]x", "bx", true},
+		{"[!]", "!", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`[\]]`, "]", true},
+		{"[abc", "b", true},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.acl")
+	content := "user default on nopass ~* &* +@all\nuser ops on #" + hashPassword("pw") + " ~* resetchannels -@all +@admin\n"
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, "aclfile "+filename+"\n")
+	if u := server.acl.user("ops"); u == nil || !u.checkPassword("pw") {
+		t.Fatalf("Expected ops to be loaded from the ACL file")
+	}
+
+	c := dialTestServer(t, server)
+	c.do(t, "ACL", "SETUSER", "ops", "off")
+	if res := c.do(t, "ACL", "SAVE"); res.str != "OK" {
+		t.Fatalf("Expected ACL SAVE to succeed, got %v", res)
+	}
+	users, err := loadACLFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users["ops"].enabled {
+		t.Errorf("Expected the saved ops user to be off")
+	}
+
+	os.WriteFile(filename, []byte("user bob on +bogus\n"), 0o644)
+	if res := c.do(t, "ACL", "LOAD"); res.typ != "error" {
+		t.Errorf("Expected an invalid ACL file to be rejected, got %v", res)
+	}
+	if server.acl.user("ops") == nil {
+		t.Errorf("Expected a failed ACL LOAD to keep the current users")
+	}
+}
+
+func TestACLLog(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+	admin.do(t, "ACL", "SETUSER", "reader", "on", ">pw", "~app:*", "+get")
+
+	reader := dialTestServer(t, server)
+	reader.do(t, "AUTH", "reader", "wrong")
+	reader.do(t, "AUTH", "reader", "pw")
+	reader.do(t, "SET", "app:1", "v")
+	reader.do(t, "SET", "app:1", "v")
+	reader.do(t, "GET", "secret")
+
+	res := admin.do(t, "ACL", "LOG")
+	if len(res.array) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", res)
+	}
+	fields := func(entry Value) map[string]Value {
+		m := map[string]Value{}
+		for i := 0; i+1 < len(entry.array); i += 2 {
+			m[entry.array[i].bulk] = entry.array[i+1]
+		}
+		return m
+	}
+	// newest first
+	want := []struct {
+		reason, object string
+		count          int
+	}{{"key", "secret", 1}, {"command", "set", 2}, {"auth", "AUTH", 1}}
+	for i, w := range want {
+		entry := fields(res.array[i])
+		if entry["reason"].bulk != w.reason || entry["object"].bulk != w.object || entry["count"].num != w.count || entry["username"].bulk != "reader" {
+			t.Errorf("Entry %d: expected %+v, got %v", i, w, res.array[i])
+		}
+	}
+	if !strings.Contains(fields(res.array[0])["client-info"].bulk, "user=reader") {
+		t.Errorf("Expected the client info of the reader, got %v", res.array[0])
+	}
+
+	info := admin.do(t, "INFO", "stats").bulk
+	for _, line := range []string{"acl_access_denied_auth:1", "acl_access_denied_cmd:2", "acl_access_denied_key:1"} {
+		if !strings.Contains(info, line) {
+			t.Errorf("Expected INFO to contain %q", line)
+		}
+	}
+
+	if res := admin.do(t, "ACL", "LOG", "1"); len(res.array) != 1 {
+		t.Errorf("Expected one entry, got %v", res)
+	}
+	admin.do(t, "ACL", "LOG", "RESET")
+	if res := admin.do(t, "ACL", "LOG"); len(res.array) != 0 {
+		t.Errorf("Expected an empty log after RESET, got %v", res)
+	}
+}
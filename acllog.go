@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a denial repeating an entry within this window only bumps its count
+const aclLogGroupWindow = 60 * time.Second
+
+type aclLogEntry struct {
+	id int64
+	// "auth", "command" or "key"
+	reason   string
+	object   string
+	username string
+	// CLIENT INFO of the last client the entry was recorded for
+	clientInfo string
+	count      int
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLog keeps the most recent ACL denials and failed AUTHs for ACL LOG
+type aclLog struct {
+	lock    sync.Mutex
+	entries ring[*aclLogEntry]
+	nextID  int64
+}
+
+// configure applies acllog-max-len
+func (l *aclLog) configure(maxLen int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries.resize(maxLen)
+}
+
+// record adds a denial, or counts it against a recent identical entry
+func (l *aclLog) record(reason, object, username string, client *Client) {
+	now := time.Now()
+	clientInfo := ""
+	if client != nil {
+		clientInfo = client.info()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := 0; i < l.entries.len(); i++ {
+		entry := l.entries.at(i)
+		if entry.reason == reason && entry.object == object && entry.username == username &&
+			now.Sub(entry.updated) < aclLogGroupWindow {
+			entry.count++
+			entry.updated = now
+			entry.clientInfo = clientInfo
+			return
+		}
+	}
+	// a key may still point into the client's read buffer
+	l.entries.push(&aclLogEntry{
+		id:         l.nextID,
+		reason:     reason,
+		object:     strings.Clone(object),
+		username:   username,
+		clientInfo: clientInfo,
+		count:      1,
+		created:    now,
+		updated:    now,
+	})
+	l.nextID++
+}
+
+// recordACLDenial counts a denial for INFO and adds it to ACL LOG
+func (e *Executor) recordACLDenial(reason, object, username string) {
+	switch reason {
+	case "auth":
+		e.server.stats.aclDeniedAuth.Add(1)
+	case "command":
+		e.server.stats.aclDeniedCmd.Add(1)
+	case "key":
+		e.server.stats.aclDeniedKey.Add(1)
+	}
+	e.server.acllog.record(reason, object, username, e.client)
+}
+
+// handleACLLog implements ACL LOG [count | RESET]
+func (e *Executor) handleACLLog(args []Value) Value {
+	l := e.server.acllog
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'acl|log' command"}
+	}
+	count := 10
+	if len(args) == 1 {
+		if strings.EqualFold(args[0].bulk, "RESET") {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.entries.reset()
+			return Value{typ: "string", str: "OK"}
+		}
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count = min(count, l.entries.len())
+	now := time.Now()
+	res := Value{typ: "array", array: make([]Value, 0, count)}
+	// newest first
+	for i := l.entries.len() - 1; i >= l.entries.len()-count; i-- {
+		res.array = append(res.array, l.entries.at(i).marshal(now))
+	}
+	return res
+}
+
+// marshal builds the ACL LOG reply for an entry
+func (entry *aclLogEntry) marshal(now time.Time) Value {
+	bulk := func(s string) Value { return Value{typ: "bulk", bulk: s} }
+	integer := func(n int64) Value { return Value{typ: "integer", num: int(n)} }
+	return Value{typ: "map", array: []Value{
+		bulk("count"), integer(int64(entry.count)),
+		bulk("reason"), bulk(entry.reason),
+		bulk("context"), bulk("toplevel"),
+		bulk("object"), bulk(entry.object),
+		bulk("username"), bulk(entry.username),
+		bulk("age-seconds"), {typ: "double", double: float64(now.Sub(entry.created).Milliseconds()) / 1000},
+		bulk("client-info"), bulk(entry.clientInfo),
+		bulk("entry-id"), integer(entry.id),
+		bulk("timestamp-created"), integer(entry.created.UnixMilli()),
+		bulk("timestamp-last-updated"), integer(entry.updated.UnixMilli()),
+	}}
+}
@@ -1,37 +1,401 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// how often a failed AOF write is retried, and the everysec fsync period
+const aofRetryInterval = time.Second
+
+// when the AOF is fsynced (appendfsync)
+type fsyncPolicy int32
+
+const (
+	fsyncNo fsyncPolicy = iota
+	fsyncEverysec
+	fsyncAlways
+)
+
+func parseFsyncPolicy(name string) (fsyncPolicy, error) {
+	switch name {
+	case "no":
+		return fsyncNo, nil
+	case "everysec":
+		return fsyncEverysec, nil
+	case "always":
+		return fsyncAlways, nil
+	}
+	return 0, fmt.Errorf("unknown appendfsync policy %q", name)
+}
+
 type AOF struct {
+	// a single file, or one segment per KV shard in sharded mode
+	files []*aofFile
+	// routes commands to segments, nil unless sharded
+	kv *KV
+	// AOF written before sharding was enabled, replayed before the segments
+	legacy *aofFile
+	// set when legacy is copied into the segments during load
+	migrateLegacy bool
+	// orders commands across segments in sharded mode
+	seq  atomic.Int64
+	done chan struct{}
+	// Close only runs once, later calls return the first result
+	closeOnce sync.Once
+	closeErr  error
+	// replay progress while the dataset is loading
+	loading loadingState
+	// fsyncPolicy, shared with the files
+	fsync atomic.Int32
+	// write and fsync timings, shared with the files
+	metrics aofMetrics
+}
+
+// aofMetrics tracks how long the disk takes, exported on /metrics
+type aofMetrics struct {
+	write        latencyHistogram
+	fsync        latencyHistogram
+	writtenBytes atomic.Int64
+	// samples slow writes and fsyncs, nil when not monitored
+	latency *latencyMonitor
+}
+
+type aofFile struct {
+	name string
 	file *os.File
 	lock sync.RWMutex
+	// number of bytes known to be in the file
+	size int64
+	// bytes that could not be written yet, retried in order
+	pending []byte
+	// last write error, nil when the file is healthy
+	writeErr     error
+	writeErrTime time.Time
+	// fast path for executors checking whether writes are allowed
+	failing atomic.Bool
+	// encrypts appended commands, nil for a plaintext AOF
+	cipher *aofCipher
+	// written since the last fsync
+	dirty   bool
+	fsync   *atomic.Int32
+	metrics *aofMetrics
 }
 
-func newAOF(filename string) (*AOF, error) {
+// newAOF opens (or creates) the AOF. With a non-nil key the file is written
+// as AES-GCM frames, see aofcrypt.go.
+func newAOF(filename string, key []byte) (*AOF, error) {
+	if _, err := os.Stat(segmentName(filename, 0)); err == nil {
+		return nil, fmt.Errorf("found sharded AOF segment %s, enable sharded AOF to load it", segmentName(filename, 0))
+	}
+	aof := &AOF{
+		done: make(chan struct{}),
+	}
+	aof.fsync.Store(int32(fsyncEverysec))
+	file, err := aof.openFile(filename, key)
+	if err != nil {
+		return nil, err
+	}
+	aof.files = []*aofFile{file}
+	go aof.backgroundLoop()
+	return aof, nil
+}
+
+func (aof *AOF) openFile(filename string, key []byte) (*aofFile, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
-	return &AOF{
-		file: file,
-	}, nil
+	f := &aofFile{
+		name:    filename,
+		file:    file,
+		fsync:   &aof.fsync,
+		metrics: &aof.metrics,
+	}
+	if err := f.init(key); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// init checks the file header against the encryption settings
+func (f *aofFile) init(key []byte) error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.size = info.Size()
+
+	header := make([]byte, aofHeaderSize)
+	n, err := f.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	header = header[:n]
+
+	if key == nil {
+		if isEncryptedAOFHeader(header) {
+			return errors.New("AOF file is encrypted but no encryption key is configured")
+		}
+		return nil
+	}
+	f.cipher, err = newAOFCipher(key)
+	if err != nil {
+		return err
+	}
+	if f.size == 0 {
+		header = f.cipher.header()
+		if _, err := f.file.Write(header); err != nil {
+			return err
+		}
+		f.size = int64(len(header))
+		return nil
+	}
+	return f.cipher.checkHeader(header)
+}
+
+// headerSize is the size of an empty file
+func (f *aofFile) headerSize() int64 {
+	if f.cipher == nil {
+		return 0
+	}
+	return int64(aofHeaderSize)
+}
+
+// reader returns the file contents as a RESP stream, decrypting if needed.
+// Bytes read are reported to loading.
+func (f *aofFile) reader(loading *loadingState) io.Reader {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.cipher == nil {
+		return loading.track(io.NewSectionReader(f.file, 0, f.size))
+	}
+	loading.loadedBytes.Add(int64(aofHeaderSize))
+	return &aofFrameReader{
+		src:    loading.track(io.NewSectionReader(f.file, int64(aofHeaderSize), f.size-int64(aofHeaderSize))),
+		cipher: f.cipher,
+		offset: int64(aofHeaderSize),
+		size:   f.size,
+	}
+}
+
+// truncate cuts the file back to size, used to repair a torn last write
+func (f *aofFile) truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.size = size
+	return nil
 }
 
 func (aof *AOF) Close() error {
-	aof.lock.Lock()
-	defer aof.lock.Unlock()
-	return aof.file.Close()
+	aof.closeOnce.Do(func() {
+		close(aof.done)
+		for _, f := range aof.files {
+			if err := f.close(); err != nil && aof.closeErr == nil {
+				aof.closeErr = err
+			}
+		}
+		if aof.legacy != nil {
+			aof.legacy.close()
+		}
+	})
+	return aof.closeErr
+}
+
+func (f *aofFile) close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.pending) > 0 {
+		if err := f.flushPending(); err != nil {
+			logWarningf("AOF %s closed with %d unwritten bytes: %v", f.name, len(f.pending), err)
+		}
+	}
+	return f.file.Close()
 }
 
+// append writes the command to the AOF. Write errors don't stop the server:
+// the bytes are kept and retried in the background while writeError reports
+// the failure so executors can reject further writes.
 func (aof *AOF) append(v Value) {
-	aof.lock.Lock()
-	defer aof.lock.Unlock()
-	rawBytes := v.Marshal()
-	_, err := aof.file.Write(rawBytes)
-	if err != nil {
-		panic(err)
+	if aof.kv != nil {
+		aof.appendSharded(v)
+		return
+	}
+	f := aof.files[0]
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.appendLocked(v.Marshal())
+}
+
+// appendLocked queues and writes a marshalled record, caller must hold f.lock
+func (f *aofFile) appendLocked(rawBytes []byte) {
+	if f.cipher != nil {
+		// frames are bound to the offset they'll be written at
+		rawBytes = f.cipher.seal(rawBytes, f.size+int64(len(f.pending)))
+	}
+	f.pending = append(f.pending, rawBytes...)
+	if f.writeErr != nil {
+		// queue behind the failed bytes so the file keeps command order
+		return
+	}
+	f.flushPending()
+}
+
+// flushPending writes the pending buffer, caller must hold f.lock
+func (f *aofFile) flushPending() error {
+	start := time.Now()
+	n, err := f.file.Write(f.pending)
+	f.metrics.write.observe(time.Since(start))
+	f.metrics.latency.add("aof-write", time.Since(start))
+	f.metrics.writtenBytes.Add(int64(n))
+	if n > 0 {
+		f.dirty = true
+	}
+	if err == nil && fsyncPolicy(f.fsync.Load()) == fsyncAlways {
+		// with always a command isn't acknowledged before it's on disk
+		err = f.sync("aof-fsync-always")
+		if err == nil {
+			f.dirty = false
+		}
+	}
+	if err == nil {
+		f.size += int64(n)
+		f.pending = f.pending[:0]
+		if f.writeErr != nil {
+			logWarningf("AOF %s write error looks solved, writes are allowed again", f.name)
+			f.writeErr = nil
+			f.failing.Store(false)
+		}
+		return nil
+	}
+
+	// drop a half-written command so the retry doesn't leave garbage in the file
+	if n > 0 {
+		if terr := f.file.Truncate(f.size); terr != nil {
+			// the partial write stays on disk, only retry what's missing
+			f.size += int64(n)
+			f.pending = f.pending[n:]
+		}
+	}
+	if f.writeErr == nil {
+		logWarningf("error writing to AOF %s, rejecting writes until it recovers: %v", f.name, err)
+		f.writeErrTime = time.Now()
+	}
+	f.writeErr = err
+	f.failing.Store(true)
+	return err
+}
+
+// sync fsyncs the file, recording how long it took as a latency event
+func (f *aofFile) sync(event string) error {
+	start := time.Now()
+	err := f.file.Sync()
+	f.metrics.fsync.observe(time.Since(start))
+	f.metrics.latency.add(event, time.Since(start))
+	return err
+}
+
+// backgroundLoop retries failed writes and runs the everysec fsync
+func (aof *AOF) backgroundLoop() {
+	ticker := time.NewTicker(aofRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-ticker.C:
+			aof.retry()
+			if fsyncPolicy(aof.fsync.Load()) == fsyncEverysec {
+				aof.syncFiles()
+			}
+		}
+	}
+}
+
+// setFsyncPolicy changes when the AOF is fsynced
+func (aof *AOF) setFsyncPolicy(policy fsyncPolicy) {
+	aof.fsync.Store(int32(policy))
+}
+
+// syncFiles fsyncs files written since the last sync. The sync runs without
+// the file lock so appends aren't blocked behind the disk.
+func (aof *AOF) syncFiles() {
+	for _, f := range aof.files {
+		f.lock.Lock()
+		dirty := f.dirty
+		f.dirty = false
+		f.lock.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := f.sync("aof-fsync-everysec"); err != nil {
+			logWarningf("error fsyncing AOF %s: %v", f.name, err)
+			f.lock.Lock()
+			f.dirty = true
+			f.lock.Unlock()
+		}
+	}
+}
+
+// retry attempts to write the pending bytes of every failing file
+func (aof *AOF) retry() error {
+	var firstErr error
+	for _, f := range aof.files {
+		if !f.failing.Load() {
+			continue
+		}
+		if err := f.retry(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (f *aofFile) retry() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.writeErr == nil {
+		return nil
+	}
+	return f.flushPending()
+}
+
+// writeError returns the last write error, or nil if the AOF is healthy
+func (aof *AOF) writeError() error {
+	for _, f := range aof.files {
+		if !f.failing.Load() {
+			continue
+		}
+		f.lock.RLock()
+		err := f.writeErr
+		f.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// misconfError builds the reply sent to write commands while the AOF is failing
+func misconfError(err error) Value {
+	return Value{typ: "error", str: "MISCONF Errors writing to the AOF file: " + aofErrorCause(err)}
+}
+
+// aofErrorCause reports the underlying cause ("no space left on device") rather than the path
+func aofErrorCause(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
 	}
+	return err.Error()
 }
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func command(args ...string) Value {
+	v := Value{typ: "array"}
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: "bulk", bulk: arg})
+	}
+	return v
+}
+
+func TestAOFWriteErrorRejectsWrites(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	defer aof.Close()
+
+	executor := NewExecutor(NewKV(4), aof)
+	executor.handleCommand(command("SET", "before", "1"))
+
+	// swap in a read-only handle so every write fails
+	writable := aof.files[0].file
+	readOnly, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Failed to open AOF read-only: %v", err)
+	}
+	aof.files[0].file = readOnly
+
+	res := executor.handleCommand(command("SET", "lost", "2"))
+	if res.typ != "string" {
+		t.Errorf("Expected the failing write to still be applied, got %v", res)
+	}
+	if aof.writeError() == nil {
+		t.Fatal("Expected a write error to be recorded")
+	}
+
+	res = executor.handleCommand(command("SET", "rejected", "3"))
+	if res.typ != "error" || !strings.HasPrefix(res.str, "MISCONF ") {
+		t.Errorf("Expected MISCONF error, got %v", res)
+	}
+	res = executor.handleCommand(command("GET", "before"))
+	if res.typ != "bulk" || res.bulk != "1" {
+		t.Errorf("Expected reads to keep working, got %v", res)
+	}
+	info := executor.handleCommand(command("INFO"))
+	if !strings.Contains(info.bulk, "aof_last_write_status:err") {
+		t.Errorf("Expected INFO to report the write error, got %q", info.bulk)
+	}
+
+	// the disk "recovers"
+	aof.files[0].file = writable
+	readOnly.Close()
+	if err := aof.retry(); err != nil {
+		t.Fatalf("Expected retry to succeed, got %v", err)
+	}
+	if aof.writeError() != nil {
+		t.Error("Expected the write error to be cleared")
+	}
+	res = executor.handleCommand(command("SET", "after", "4"))
+	if res.typ != "string" {
+		t.Errorf("Expected writes to be accepted again, got %v", res)
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read AOF: %v", err)
+	}
+	expected := string(command("SET", "before", "1").Marshal()) +
+		string(command("SET", "lost", "2").Marshal()) +
+		string(command("SET", "after", "4").Marshal())
+	if string(contents) != expected {
+		t.Errorf("Expected AOF contents %q, got %q", expected, contents)
+	}
+}
+
+func TestAOFCloseTwice(t *testing.T) {
+	aof, err := newAOF(filepath.Join(t.TempDir(), "append-only.aof"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatalf("Failed to close AOF: %v", err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Errorf("Expected a second Close to return the first result, got %v", err)
+	}
+}
+
+var testAOFKey = bytes.Repeat([]byte{0x42}, 32)
+
+func TestEncryptedAOFRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	executor := NewExecutor(NewKV(4), aof)
+	executor.handleCommand(command("SET", "secret", "customer-data"))
+	executor.handleCommand(command("INCR", "counter"))
+	aof.Close()
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read AOF: %v", err)
+	}
+	if bytes.Contains(contents, []byte("customer-data")) {
+		t.Error("Expected AOF to not contain plaintext values")
+	}
+
+	aof, err = newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to reopen AOF: %v", err)
+	}
+	defer aof.Close()
+	kv := NewKV(4)
+	loadAOF(kv, aof)
+	if res := kv.get("secret"); res.bulk != "customer-data" {
+		t.Errorf("Expected 'customer-data', got %v", res)
+	}
+	if res := kv.get("counter"); res.bulk != "1" {
+		t.Errorf("Expected '1', got %v", res)
+	}
+}
+
+func TestEncryptedAOFTruncatedTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	aof.append(command("SET", "a", "1"))
+	goodSize := aof.files[0].size
+	aof.append(command("SET", "b", "2"))
+	aof.Close()
+
+	// simulate a crash in the middle of the last write
+	if err := os.Truncate(filename, goodSize+5); err != nil {
+		t.Fatalf("Failed to truncate AOF: %v", err)
+	}
+
+	aof, err = newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to reopen AOF: %v", err)
+	}
+	kv := NewKV(4)
+	loadAOF(kv, aof)
+	if res := kv.get("a"); res.bulk != "1" {
+		t.Errorf("Expected 'a' to be restored, got %v", res)
+	}
+	if res := kv.get("b"); res.typ != "null" {
+		t.Errorf("Expected 'b' to be dropped, got %v", res)
+	}
+	if aof.files[0].size != goodSize {
+		t.Errorf("Expected AOF to be repaired to %d bytes, got %d", goodSize, aof.files[0].size)
+	}
+
+	// appends after the repair must still be readable
+	aof.append(command("SET", "c", "3"))
+	aof.Close()
+	aof, err = newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to reopen AOF: %v", err)
+	}
+	defer aof.Close()
+	kv = NewKV(4)
+	loadAOF(kv, aof)
+	if res := kv.get("c"); res.bulk != "3" {
+		t.Errorf("Expected 'c' to be restored, got %v", res)
+	}
+}
+
+func TestEncryptedAOFTamperedTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	aof.append(command("SET", "a", "1"))
+	aof.append(command("SET", "b", "2"))
+	size := aof.files[0].size
+	aof.Close()
+
+	// flip a bit in the last frame, which is still complete
+	data, _ := os.ReadFile(filename)
+	data[len(data)-1] ^= 1
+	os.WriteFile(filename, data, 0o644)
+
+	aof, err = newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to reopen AOF: %v", err)
+	}
+	defer aof.Close()
+	kv := NewKV(4)
+	loadAOF(kv, aof)
+	if res := kv.get("a"); res.bulk != "1" {
+		t.Errorf("Expected 'a' to be restored, got %v", res)
+	}
+	// a corrupt frame isn't mistaken for a torn write and truncated away
+	if info, _ := os.Stat(filename); info.Size() != size {
+		t.Errorf("Expected the tampered AOF to keep its %d bytes, got %d", size, info.Size())
+	}
+
+	reader := &aofFrameReader{src: bytes.NewReader(data[aofHeaderSize:]), cipher: aof.files[0].cipher, offset: int64(aofHeaderSize), size: int64(len(data))}
+	_, err = io.ReadAll(reader)
+	var truncated *aofTruncatedError
+	if err == nil || errors.As(err, &truncated) || !strings.Contains(err.Error(), "failed authentication") {
+		t.Errorf("Expected an authentication failure, got %v", err)
+	}
+}
+
+func TestEncryptedAOFKeyMismatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, testAOFKey)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	aof.append(command("SET", "a", "1"))
+	aof.Close()
+
+	if _, err := newAOF(filename, bytes.Repeat([]byte{0x24}, 32)); err != errAOFWrongKey {
+		t.Errorf("Expected wrong key error, got %v", err)
+	}
+	if _, err := newAOF(filename, nil); err == nil {
+		t.Error("Expected an error opening an encrypted AOF without a key")
+	}
+}
+
+func TestParseAOFKey(t *testing.T) {
+	key, err := parseAOFKey([]byte(strings.Repeat("ab", 32) + "\n"))
+	if err != nil || len(key) != 32 || key[0] != 0xab {
+		t.Errorf("Expected hex key to parse, got %v %v", key, err)
+	}
+	if _, err := parseAOFKey([]byte("too-short")); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+	passphrase := strings.Repeat("p", 32)
+	if _, err := parseAOFKey([]byte(passphrase)); err == nil {
+		t.Error("Expected a 32 character passphrase to be rejected")
+	}
+	t.Setenv("AOF_ENCRYPTION_KEY", passphrase)
+	if _, err := loadAOFKey(""); err == nil {
+		t.Error("Expected AOF_ENCRYPTION_KEY to require hex")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "aof.key")
+	os.WriteFile(keyFile, []byte(passphrase), 0o600)
+	if key, err := readAOFKeyFile(keyFile); err != nil || string(key) != passphrase {
+		t.Errorf("Expected a key file to hold raw bytes, got %v %v", key, err)
+	}
+}
+
+func TestShardedAOFReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	kv := NewKV(4)
+	aof, err := newShardedAOF(filename, nil, kv)
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	executor := NewExecutor(kv, aof)
+	for i := 0; i < 50; i++ {
+		executor.handleCommand(command("INCR", fmt.Sprintf("counter-%d", i%7)))
+	}
+	executor.handleCommand(command("MSET", "a", "1", "b", "2", "c", "3", "d", "4"))
+	executor.handleCommand(command("RENAME", "a", "renamed"))
+	executor.handleCommand(command("INCR", "renamed"))
+	executor.handleCommand(command("FLUSHDB"))
+	executor.handleCommand(command("SET", "x", "after-flush"))
+	executor.handleCommand(command("MSET", "y", "1", "z", "2"))
+	executor.handleCommand(command("DEL", "y", "missing"))
+	executor.handleCommand(command("INCR", "z"))
+	aof.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, err := os.Stat(segmentName(filename, i)); err != nil {
+			t.Errorf("Expected segment %d to exist: %v", i, err)
+		}
+	}
+
+	replayed := NewKV(4)
+	aof, err = newShardedAOF(filename, nil, replayed)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded AOF: %v", err)
+	}
+	defer aof.Close()
+	loadAOF(replayed, aof)
+
+	expected := map[string]string{"x": "after-flush", "z": "3"}
+	res := replayed.keys("*")
+	if len(res.array) != len(expected) {
+		t.Errorf("Expected %d keys after replay, got %v", len(expected), res.array)
+	}
+	for key, val := range expected {
+		if got := replayed.get(key); got.bulk != val {
+			t.Errorf("Expected %s=%s, got %v", key, val, got)
+		}
+	}
+	if aof.seq.Load() == 0 {
+		t.Error("Expected sequence numbers to continue after replay")
+	}
+}
+
+func TestShardedAOFShardCountChange(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	kv := NewKV(4)
+	aof, err := newShardedAOF(filename, nil, kv)
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	executor := NewExecutor(kv, aof)
+	for i := 0; i < 20; i++ {
+		executor.handleCommand(command("SET", fmt.Sprintf("key-%d", i), "old"))
+	}
+	executor.handleCommand(command("FLUSHDB"))
+	executor.handleCommand(command("SET", "key-1", "new"))
+	aof.Close()
+
+	// restarting with fewer or more shards would split the keys' histories
+	// across unordered segments
+	for _, shards := range []int{2, 8} {
+		if aof, err := newShardedAOF(filename, nil, NewKV(shards)); err == nil {
+			aof.Close()
+			t.Errorf("Expected a restart with %d shards to be refused", shards)
+		} else if !strings.Contains(err.Error(), "4 segments") {
+			t.Errorf("Expected the error to name the segment count, got %v", err)
+		}
+	}
+	if _, err := os.Stat(segmentName(filename, 4)); err == nil {
+		t.Errorf("Expected the refused restart not to create segments")
+	}
+
+	replayed := NewKV(4)
+	aof, err = newShardedAOF(filename, nil, replayed)
+	if err != nil {
+		t.Fatalf("Failed to reopen with the original shard count: %v", err)
+	}
+	defer aof.Close()
+	loadAOF(replayed, aof)
+	if res := replayed.keys("*"); len(res.array) != 1 {
+		t.Errorf("Expected only key-1 after replay, got %v", res.array)
+	}
+}
+
+func TestShardedAOFMissingBarrierRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	kv := NewKV(2)
+	aof, err := newShardedAOF(filename, nil, kv)
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	aof.append(command("SET", "k1", "v1"))
+	aof.append(command("SET", "k2", "v2"))
+	aof.append(command("SET", "k3", "v3"))
+	// a crash in the middle of a cross-shard append: the record only made it
+	// to the first segment
+	seq := aof.seq.Add(1)
+	aof.files[0].appendLocked(segmentRecord(seq, []int{0, 1}, command("SET", "k4", "v4")).Marshal())
+	aof.Close()
+
+	replayed := NewKV(2)
+	aof, err = newShardedAOF(filename, nil, replayed)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded AOF: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		loadAOF(replayed, aof)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replay deadlocked on an incomplete barrier")
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if got := replayed.get(key); got.typ != "bulk" {
+			t.Errorf("Expected %s to be replayed, got %v", key, got)
+		}
+	}
+
+	// the record is completed during replay, so newer writes on the second
+	// segment replay after it next time
+	aof.append(command("FLUSHDB"))
+	aof.append(command("SET", "k5", "v5"))
+	aof.Close()
+
+	replayed = NewKV(2)
+	aof, err = newShardedAOF(filename, nil, replayed)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded AOF: %v", err)
+	}
+	defer aof.Close()
+	loadAOF(replayed, aof)
+	if res := replayed.keys("*"); len(res.array) != 1 || res.array[0].bulk != "k5" {
+		t.Errorf("Expected only k5 after the second replay, got %v", res.array)
+	}
+}
+
+func TestShardedAOFMigratesLegacyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	aof.append(command("SET", "old", "1"))
+	aof.append(command("MSET", "a", "1", "b", "2", "c", "3"))
+	aof.Close()
+
+	kv := NewKV(4)
+	aof, err = newShardedAOF(filename, nil, kv)
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	loadAOF(kv, aof)
+	aof.append(command("INCR", "old"))
+	aof.Close()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected the legacy AOF to be moved aside, got %v", err)
+	}
+	if _, err := os.Stat(filename + ".migrated"); err != nil {
+		t.Errorf("Expected the legacy AOF to be kept as %s.migrated: %v", filename, err)
+	}
+
+	replayed := NewKV(4)
+	aof, err = newShardedAOF(filename, nil, replayed)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded AOF: %v", err)
+	}
+	defer aof.Close()
+	if aof.legacy != nil {
+		t.Errorf("Expected the migrated AOF not to be replayed again, got %s", aof.legacy.name)
+	}
+	loadAOF(replayed, aof)
+	if got := replayed.get("old"); got.bulk != "2" {
+		t.Errorf("Expected legacy record followed by segment record, got %v", got)
+	}
+	if got := replayed.get("c"); got.bulk != "3" {
+		t.Errorf("Expected the legacy MSET to be migrated, got %v", got)
+	}
+
+	if _, err := newAOF(filename, nil); err == nil {
+		t.Error("Expected single-file mode to refuse existing segments")
+	}
+}
+
+func TestShardedAOFRestartsInterruptedMigration(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	aof.append(command("INCR", "n"))
+	aof.append(command("INCR", "n"))
+	aof.Close()
+
+	// crash after part of the legacy file was copied
+	aof, err = newShardedAOF(filename, nil, NewKV(4))
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	aof.appendSharded(command("INCR", "n"))
+	aof.Close()
+
+	kv := NewKV(4)
+	aof, err = newShardedAOF(filename, nil, kv)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded AOF: %v", err)
+	}
+	defer aof.Close()
+	loadAOF(kv, aof)
+	if got := kv.get("n"); got.bulk != "2" {
+		t.Errorf("Expected the copy to start over, got %v", got)
+	}
+	if _, err := os.Stat(filename + ".migrating"); !os.IsNotExist(err) {
+		t.Errorf("Expected the migration to finish, got %v", err)
+	}
+}
+
+func TestShardedAOFReplaysLegacyHistory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newShardedAOF(filename, nil, NewKV(4))
+	if err != nil {
+		t.Fatalf("Failed to create sharded AOF: %v", err)
+	}
+	aof.append(command("INCR", "old"))
+	aof.Close()
+	// a legacy file next to segments that already hold records
+	os.WriteFile(filename, command("SET", "old", "1").Marshal(), 0o644)
+
+	for i := 0; i < 2; i++ {
+		kv := NewKV(4)
+		aof, err = newShardedAOF(filename, nil, kv)
+		if err != nil {
+			t.Fatalf("Failed to reopen sharded AOF: %v", err)
+		}
+		loadAOF(kv, aof)
+		aof.Close()
+		if got := kv.get("old"); got.bulk != "2" {
+			t.Errorf("Expected legacy record followed by segment record, got %v", got)
+		}
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("Expected the legacy AOF to stay in place: %v", err)
+	}
+}
+
+func TestLoadingRejectsCommands(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "append-only.aof")
+	aof, err := newAOF(filename, nil)
+	if err != nil {
+		t.Fatalf("Failed to create AOF: %v", err)
+	}
+	defer aof.Close()
+	aof.append(command("SET", "a", "1"))
+	aof.append(command("SET", "b", "2"))
+
+	executor := NewExecutor(NewKV(4), aof)
+	aof.loading.start(aof.loadSize())
+	res := executor.handleCommand(command("GET", "a"))
+	if res.typ != "error" || !strings.HasPrefix(res.str, "LOADING ") {
+		t.Errorf("Expected LOADING error, got %v", res)
+	}
+	info := executor.handleCommand(command("INFO"))
+	if !strings.Contains(info.bulk, "loading:1\r\n") || !strings.Contains(info.bulk, "loading_total_bytes:") {
+		t.Errorf("Expected INFO to report loading progress, got %q", info.bulk)
+	}
+
+	loadAOF(executor.db, aof)
+	if aof.loading.commands.Load() != 2 {
+		t.Errorf("Expected 2 replayed commands, got %d", aof.loading.commands.Load())
+	}
+	if aof.loading.loadedBytes.Load() != aof.loading.totalBytes.Load() {
+		t.Errorf("Expected all %d bytes to be loaded, got %d", aof.loading.totalBytes.Load(), aof.loading.loadedBytes.Load())
+	}
+	res = executor.handleCommand(command("GET", "a"))
+	if res.typ != "bulk" || res.bulk != "1" {
+		t.Errorf("Expected commands to be served after loading, got %v", res)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted AOF layout:
+//
+//	header: magic | version | nonce | tag of an empty message (key check)
+//	frame:  length of sealed data (uint32) | nonce | sealed command
+//
+// Every appended command is sealed in its own frame so the file can still be
+// written as a stream. The frame's file offset is authenticated as additional
+// data, which stops frames from being reordered or spliced between files.
+const (
+	aofCryptMagic   = "RCAOFGCM"
+	aofCryptVersion = 1
+	aofNonceSize    = 12
+	aofTagSize      = 16
+	aofHeaderSize   = len(aofCryptMagic) + 1 + aofNonceSize + aofTagSize
+	aofFrameHeader  = 4 + aofNonceSize
+	// upper bound on a sealed frame, anything bigger is treated as corruption
+	aofMaxFrameSize = 512 << 20
+)
+
+var aofKeyCheckData = []byte("aof-key-check")
+
+var errAOFWrongKey = errors.New("AOF encryption key does not match the key the file was written with")
+
+// aofTruncatedError is returned while reading an encrypted AOF whose last
+// frame is shorter than its length says, i.e. was only partially written.
+// offset is where the last complete frame ends.
+type aofTruncatedError struct {
+	offset int64
+}
+
+func (e *aofTruncatedError) Error() string {
+	return fmt.Sprintf("AOF has a truncated tail after offset %d", e.offset)
+}
+
+type aofCipher struct {
+	aead cipher.AEAD
+}
+
+// loadAOFKey reads the AOF encryption key from the AOF_ENCRYPTION_KEY
+// environment variable, the configured key file or AOF_ENCRYPTION_KEY_FILE,
+// in that order. It returns a nil key when encryption isn't configured.
+func loadAOFKey(keyFile string) ([]byte, error) {
+	if hexKey := os.Getenv("AOF_ENCRYPTION_KEY"); hexKey != "" {
+		key, err := parseAOFKey([]byte(hexKey))
+		if err != nil {
+			return nil, errors.New("AOF_ENCRYPTION_KEY must be 64 hex characters")
+		}
+		return key, nil
+	}
+	if keyFile == "" {
+		keyFile = os.Getenv("AOF_ENCRYPTION_KEY_FILE")
+	}
+	if keyFile != "" {
+		return readAOFKeyFile(keyFile)
+	}
+	return nil, nil
+}
+
+// readAOFKeyFile reads a key file holding 32 raw bytes or 64 hex characters
+func readAOFKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading AOF key file: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := parseAOFKey(data)
+	if err != nil {
+		return nil, errors.New("AOF key file must hold 32 raw bytes or 64 hex characters")
+	}
+	return key, nil
+}
+
+// parseAOFKey decodes a key given as 64 hex characters (AES-256). Raw keys
+// are only accepted from a key file, a 32 character passphrase isn't a key.
+func parseAOFKey(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 64 {
+		key := make([]byte, 32)
+		if _, err := hex.Decode(key, trimmed); err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("AOF encryption key must be 64 hex characters")
+}
+
+func newAOFCipher(key []byte) (*aofCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aofCipher{aead: aead}, nil
+}
+
+func (c *aofCipher) header() []byte {
+	header := make([]byte, 0, aofHeaderSize)
+	header = append(header, aofCryptMagic...)
+	header = append(header, aofCryptVersion)
+	nonce := make([]byte, aofNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	header = append(header, nonce...)
+	return c.aead.Seal(header, nonce, nil, aofKeyCheckData)
+}
+
+// checkHeader verifies the file header against this cipher's key
+func (c *aofCipher) checkHeader(header []byte) error {
+	if !isEncryptedAOFHeader(header) {
+		return errors.New("AOF file is not encrypted, refusing to mix plaintext and encrypted commands")
+	}
+	if header[len(aofCryptMagic)] != aofCryptVersion {
+		return fmt.Errorf("unsupported encrypted AOF version %d", header[len(aofCryptMagic)])
+	}
+	nonce := header[len(aofCryptMagic)+1 : len(aofCryptMagic)+1+aofNonceSize]
+	tag := header[len(aofCryptMagic)+1+aofNonceSize:]
+	if _, err := c.aead.Open(nil, nonce, tag, aofKeyCheckData); err != nil {
+		return errAOFWrongKey
+	}
+	return nil
+}
+
+func isEncryptedAOFHeader(header []byte) bool {
+	return len(header) >= aofHeaderSize && string(header[:len(aofCryptMagic)]) == aofCryptMagic
+}
+
+// seal encrypts a marshalled command into a frame that will be written at offset
+func (c *aofCipher) seal(plaintext []byte, offset int64) []byte {
+	frame := make([]byte, aofFrameHeader, aofFrameHeader+len(plaintext)+aofTagSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(plaintext)+aofTagSize))
+	nonce := frame[4:aofFrameHeader]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return c.aead.Seal(frame, nonce, plaintext, frameAAD(offset))
+}
+
+func frameAAD(offset int64) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, uint64(offset))
+	return aad
+}
+
+// aofFrameReader decrypts frames and exposes the commands as a plain RESP stream
+type aofFrameReader struct {
+	src    io.Reader
+	cipher *aofCipher
+	// offset of the next frame
+	offset int64
+	// total file size, used to tell a torn last frame from corruption
+	size int64
+	buf  []byte
+}
+
+func (r *aofFrameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *aofFrameReader) nextFrame() error {
+	header := make([]byte, aofFrameHeader)
+	if _, err := io.ReadFull(r.src, header); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return r.truncated(err)
+	}
+	sealedSize := binary.BigEndian.Uint32(header)
+	if sealedSize < aofTagSize || sealedSize > aofMaxFrameSize {
+		return fmt.Errorf("corrupt encrypted AOF frame at offset %d: invalid length %d", r.offset, sealedSize)
+	}
+	frameEnd := r.offset + aofFrameHeader + int64(sealedSize)
+	if frameEnd > r.size {
+		return &aofTruncatedError{offset: r.offset}
+	}
+	sealed := make([]byte, sealedSize)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return r.truncated(err)
+	}
+	plaintext, err := r.cipher.aead.Open(sealed[:0], header[4:], sealed, frameAAD(r.offset))
+	if err != nil {
+		// the frame is complete, so this is tampering or bit rot rather than
+		// a torn write, even for the last frame. It's reported, not truncated.
+		return fmt.Errorf("encrypted AOF frame at offset %d failed authentication, the file is corrupt or was modified: %w", r.offset, err)
+	}
+	r.offset = frameEnd
+	r.buf = plaintext
+	return nil
+}
+
+func (r *aofFrameReader) truncated(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return &aofTruncatedError{offset: r.offset}
+	}
+	return err
+}
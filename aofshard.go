@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Sharded AOF: every KV shard gets its own segment file so appends only
+// contend on the lock of the segment they touch, and startup replays the
+// segments in parallel. Each record is wrapped as
+//
+//	[seq, [segment indexes], command]
+//
+// where seq is a global sequence number. Commands spanning several shards
+// (MSET, RENAME, FLUSHDB, ...) are written to every segment involved with the
+// same seq and act as a barrier during replay: they run once all of those
+// segments have caught up to them.
+//
+// A crash in the middle of a cross-shard append leaves the record in only
+// some of its segments. Appends hold every involved segment's lock, so the
+// segments missing the record can't contain anything newer; replay runs the
+// record once they're exhausted and then appends it to them so later runs
+// see a complete barrier.
+
+func segmentName(filename string, i int) string {
+	return fmt.Sprintf("%s.%d", filename, i)
+}
+
+func newShardedAOF(filename string, key []byte, kv *KV) (*AOF, error) {
+	aof := &AOF{
+		kv:   kv,
+		done: make(chan struct{}),
+	}
+	aof.fsync.Store(int32(fsyncEverysec))
+	// a key's records are only ordered within its segment, so segments
+	// written with another shard count can't be replayed correctly
+	if existing := countSegments(filename); existing > 0 && existing != kv.shardCount {
+		return nil, fmt.Errorf("AOF %s has %d segments but shards is %d, start with shards %d to load it",
+			filename, existing, kv.shardCount, existing)
+	}
+	for i := 0; i < kv.shardCount; i++ {
+		f, err := aof.openFile(segmentName(filename, i), key)
+		if err != nil {
+			aof.closeFiles()
+			return nil, err
+		}
+		aof.files = append(aof.files, f)
+	}
+	if err := aof.openLegacy(filename, key); err != nil {
+		aof.closeFiles()
+		return nil, err
+	}
+	go aof.backgroundLoop()
+	return aof, nil
+}
+
+// openLegacy opens the AOF written before sharding was enabled. While the
+// segments are still empty it's moved aside to filename.migrating and copied
+// into them during load, then renamed to filename.migrated. A crash in
+// between leaves the .migrating file, and the copy starts over from empty
+// segments. Segments that already hold records are newer than the legacy
+// file, so it's kept as history and replayed before them.
+func (aof *AOF) openLegacy(filename string, key []byte) error {
+	migrating := filename + ".migrating"
+	if _, err := os.Stat(migrating); err == nil {
+		for _, f := range aof.files {
+			if err := f.truncate(f.headerSize()); err != nil {
+				return err
+			}
+		}
+	} else if info, err := os.Stat(filename); err != nil || info.Size() == 0 {
+		return nil
+	} else if !aof.segmentsEmpty() {
+		logNoticef("AOF segments already hold records, replaying %s before them on every start", filename)
+		legacy, err := aof.openFile(filename, key)
+		aof.legacy = legacy
+		return err
+	} else if err := os.Rename(filename, migrating); err != nil {
+		return err
+	}
+	legacy, err := aof.openFile(migrating, key)
+	if err != nil {
+		return err
+	}
+	aof.legacy = legacy
+	aof.migrateLegacy = true
+	return nil
+}
+
+func (aof *AOF) segmentsEmpty() bool {
+	for _, f := range aof.files {
+		if f.size > f.headerSize() {
+			return false
+		}
+	}
+	return true
+}
+
+// countSegments returns how many segments a previous run left, counting
+// from segment 0
+func countSegments(filename string) int {
+	n := 0
+	for {
+		if _, err := os.Stat(segmentName(filename, n)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func (aof *AOF) closeFiles() {
+	for _, f := range aof.files {
+		f.file.Close()
+	}
+}
+
+// segmentsFor returns the sorted segment indexes a command must be written to
+func (aof *AOF) segmentsFor(v Value) []int {
+	spec := lookupCommand(strings.ToUpper(v.array[0].bulk))
+	keys := spec.keys(v.array)
+	if len(keys) == 0 {
+		// keyless writes such as FLUSHDB touch every shard
+		all := make([]int, aof.kv.shardCount)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	segments := make([]int, 0, len(keys))
+	for _, key := range keys {
+		segments = append(segments, aof.kv.getShard(key).id)
+	}
+	slices.Sort(segments)
+	return slices.Compact(segments)
+}
+
+func (aof *AOF) appendSharded(v Value) {
+	segments := aof.segmentsFor(v)
+	// lock in index order, and take the sequence number while holding every
+	// lock, so each segment sees its records in increasing seq order
+	for _, i := range segments {
+		aof.files[i].lock.Lock()
+	}
+	seq := aof.seq.Add(1)
+	rawBytes := segmentRecord(seq, segments, v).Marshal()
+	for _, i := range segments {
+		aof.files[i].appendLocked(rawBytes)
+	}
+	for _, i := range segments {
+		aof.files[i].lock.Unlock()
+	}
+}
+
+func segmentRecord(seq int64, segments []int, v Value) Value {
+	indexes := Value{typ: "array", array: make([]Value, len(segments))}
+	for i, segment := range segments {
+		indexes.array[i] = Value{typ: "integer", num: segment}
+	}
+	return Value{typ: "array", array: []Value{{typ: "integer", num: int(seq)}, indexes, v}}
+}
+
+// loadShardedAOF replays the legacy file first, then one goroutine per segment
+func loadShardedAOF(kvDatabase *KV, aof *AOF) {
+	if aof.migrateLegacy {
+		migrateLegacyAOF(kvDatabase, aof)
+		return
+	}
+	if aof.legacy != nil {
+		replayAOFFile(kvDatabase, aof.legacy, &aof.loading)
+	}
+
+	coordinator := newReplayCoordinator(len(aof.files), kvDatabase, &aof.loading)
+	maxSeqs := make([]int64, len(aof.files))
+	var wg sync.WaitGroup
+	for i, f := range aof.files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer coordinator.leave()
+			maxSeqs[i] = replaySegment(kvDatabase, i, f, coordinator, &aof.loading)
+		}()
+	}
+	wg.Wait()
+
+	for _, b := range coordinator.incomplete {
+		for _, i := range b.segments {
+			if i >= len(aof.files) || b.arrived[i] {
+				continue
+			}
+			logNoticef("completing AOF record %d in segment %s", b.seq, aof.files[i].name)
+			f := aof.files[i]
+			f.lock.Lock()
+			f.appendLocked(segmentRecord(b.seq, b.segments, b.cmd).Marshal())
+			f.lock.Unlock()
+		}
+	}
+	// continue numbering after the last replayed record
+	aof.seq.Store(slices.Max(append(maxSeqs, 0)))
+}
+
+// migrateLegacyAOF replays the legacy file into the empty segments, appending
+// every command as it goes. Nothing else is in the segments and commands are
+// rejected while loading, so the segments end up in the legacy file's order.
+func migrateLegacyAOF(kvDatabase *KV, aof *AOF) {
+	parser := newRespParser(aof.legacy.reader(&aof.loading))
+	executor := NewExecutor(kvDatabase, nil)
+	for {
+		val, err := parser.readResp()
+		if err != nil {
+			if err != io.EOF {
+				repairAOFTail(aof.legacy, err)
+			}
+			break
+		}
+		executor.handleCommand(val)
+		aof.appendSharded(val)
+		aof.loading.commands.Add(1)
+	}
+
+	// the legacy file is only retired once the segments are safely on disk
+	for _, f := range aof.files {
+		f.lock.Lock()
+		err := f.writeErr
+		if err == nil {
+			err = f.sync("aof-fsync-migrate")
+		}
+		f.lock.Unlock()
+		if err != nil {
+			logWarningf("error migrating AOF %s, retrying on the next start: %v", aof.legacy.name, err)
+			return
+		}
+	}
+	migrated := strings.TrimSuffix(aof.legacy.name, ".migrating") + ".migrated"
+	if err := os.Rename(aof.legacy.name, migrated); err != nil {
+		logWarningf("error renaming migrated AOF: %v", err)
+		return
+	}
+	logNoticef("AOF %s copied into %d segments and renamed to %s", aof.legacy.name, len(aof.files), migrated)
+}
+
+// replaySegment returns the highest sequence number found in the segment
+func replaySegment(kvDatabase *KV, index int, f *aofFile, coordinator *replayCoordinator, loading *loadingState) int64 {
+	parser := newRespParser(f.reader(loading))
+	executor := NewExecutor(kvDatabase, nil)
+	maxSeq := int64(0)
+	for {
+		val, err := parser.readResp()
+		if err != nil {
+			if err != io.EOF {
+				repairAOFTail(f, err)
+			}
+			return maxSeq
+		}
+		if val.typ != "array" || len(val.array) != 3 || val.array[1].typ != "array" || val.array[2].typ != "array" {
+			logWarningf("invalid record in AOF segment %s", f.name)
+			return maxSeq
+		}
+		seq, cmd := int64(val.array[0].num), val.array[2]
+		maxSeq = max(maxSeq, seq)
+		if len(val.array[1].array) <= 1 {
+			executor.handleCommand(cmd)
+			loading.commands.Add(1)
+			continue
+		}
+		segments := make([]int, len(val.array[1].array))
+		for i, segment := range val.array[1].array {
+			segments[i] = segment.num
+		}
+		coordinator.arrive(seq, index, segments, cmd)
+	}
+}
+
+// repairAOFTail truncates a torn last record, other errors are only reported
+func repairAOFTail(f *aofFile, err error) {
+	var truncated *aofTruncatedError
+	if errors.As(err, &truncated) {
+		// a crash mid-write left a partial frame, drop it so appends stay readable
+		logWarningf("AOF %s has a truncated tail, truncating to offset %d", f.name, truncated.offset)
+		if err := f.truncate(truncated.offset); err != nil {
+			logWarningf("error truncating AOF: %v", err)
+		}
+		return
+	}
+	logWarningf("error reading from AOF %s: %v", f.name, err)
+}
+
+type replayBarrier struct {
+	seq      int64
+	segments []int
+	// segment indexes that reached the barrier
+	arrived map[int]bool
+	cmd     Value
+	done    bool
+}
+
+// replayCoordinator runs cross-segment commands once every segment that
+// contains them has reached them
+type replayCoordinator struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	// segment goroutines still replaying, and how many of them are blocked
+	running int
+	waiting int
+	pending map[int64]*replayBarrier
+	// barriers that had to run without every segment, repaired after replay
+	incomplete []*replayBarrier
+	// barriers run under c.lock, so one executor is enough
+	executor *Executor
+	loading  *loadingState
+}
+
+func newReplayCoordinator(running int, kvDatabase *KV, loading *loadingState) *replayCoordinator {
+	c := &replayCoordinator{
+		running:  running,
+		pending:  make(map[int64]*replayBarrier),
+		executor: NewExecutor(kvDatabase, nil),
+		loading:  loading,
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *replayCoordinator) arrive(seq int64, index int, segments []int, cmd Value) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, ok := c.pending[seq]
+	if !ok {
+		b = &replayBarrier{seq: seq, segments: segments, arrived: make(map[int]bool), cmd: cmd}
+		c.pending[seq] = b
+	}
+	b.arrived[index] = true
+	if len(b.arrived) == len(b.segments) {
+		c.run(seq, b)
+		return
+	}
+	c.waiting++
+	c.releaseStalled()
+	for !b.done {
+		c.cond.Wait()
+	}
+}
+
+// leave is called when a segment goroutine reaches the end of its file
+func (c *replayCoordinator) leave() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.running--
+	c.releaseStalled()
+}
+
+// releaseStalled handles records that didn't make it to every segment, e.g.
+// after a crash in the middle of a cross-shard append. Once every live
+// goroutine is blocked, the lowest pending barrier can never complete, so it
+// runs with the segments that did record it.
+func (c *replayCoordinator) releaseStalled() {
+	for c.running > 0 && c.waiting == c.running && len(c.pending) > 0 {
+		lowest := int64(-1)
+		for seq := range c.pending {
+			if lowest == -1 || seq < lowest {
+				lowest = seq
+			}
+		}
+		logWarningf("AOF record %d is missing from some segments, replaying it anyway", lowest)
+		b := c.pending[lowest]
+		c.incomplete = append(c.incomplete, b)
+		c.run(lowest, b)
+	}
+}
+
+// run executes a barrier's command and wakes the goroutines blocked on it,
+// caller must hold c.lock
+func (c *replayCoordinator) run(seq int64, b *replayBarrier) {
+	delete(c.pending, seq)
+	c.executor.handleCommand(b.cmd)
+	c.loading.commands.Add(1)
+	b.done = true
+	// everyone who arrived is blocked, except a caller completing the barrier
+	blocked := len(b.arrived)
+	if len(b.arrived) == len(b.segments) {
+		blocked--
+	}
+	c.waiting -= blocked
+	c.cond.Broadcast()
+}
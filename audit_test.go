@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	server := newTestServer(t, "audit-logfile "+filename+"\n")
+	c := dialTestServer(t, server)
+	c.do(t, "ACL", "SETUSER", "ops", "on", ">s3cret", "+@all", "~*")
+	c.do(t, "AUTH", "ops", "wrong")
+	c.do(t, "AUTH", "ops", "s3cret")
+	c.do(t, "SET", "k", "v")
+	c.do(t, "CONFIG", "SET", "requirepass", "hunter2")
+	c.do(t, "FLUSHDB")
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") || strings.Contains(string(data), "hunter2") {
+		t.Errorf("Expected passwords to be redacted, got %s", data)
+	}
+	var events []auditEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event auditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Failed to parse %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	want := []struct{ event, user, result, command string }{
+		{"command", "default", "ok", "ACL SETUSER ops on (redacted) +@all ~*"},
+		{"auth", "ops", "error", ""},
+		{"auth", "ops", "ok", ""},
+		{"command", "ops", "ok", "CONFIG SET requirepass (redacted)"},
+		{"command", "ops", "ok", "FLUSHDB"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %s", len(want), data)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Event != w.event || e.User != w.user || e.Result != w.result || strings.Join(e.Command, " ") != w.command || e.Time == "" {
+			t.Errorf("Event %d: expected %+v, got %+v", i, w, e)
+		}
+	}
+}
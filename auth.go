@@ -0,0 +1,47 @@
+package main
+
+// checkAuth rejects commands from clients that haven't authenticated yet
+func (e *Executor) checkAuth(spec *commandSpec) Value {
+	if e.client == nil || e.client.authenticated || spec.allowedBeforeAuth() {
+		return Value{}
+	}
+	return Value{typ: "error", str: "NOAUTH Authentication required."}
+}
+
+func (e *Executor) handleAuthCommand(array []Value) Value {
+	if len(array) < 1 || len(array) > 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'auth' command"}
+	}
+	if e.server == nil || e.client == nil {
+		return Value{typ: "error", str: "ERR AUTH is not available"}
+	}
+	username, password := "default", array[0].bulk
+	if len(array) == 2 {
+		username, password = array[0].bulk, array[1].bulk
+	}
+	if len(array) == 1 {
+		if u := e.server.acl.user("default"); u != nil && u.nopass {
+			return Value{typ: "error", str: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+		}
+	}
+	return e.authenticate(username, password)
+}
+
+// authenticate logs the client in as username, for AUTH and HELLO AUTH
+func (e *Executor) authenticate(username, password string) Value {
+	u := e.server.acl.authenticate(username, password)
+	if u == nil {
+		logVerbosef("failed authentication attempt from %s", e.client.addr)
+		e.recordACLDenial("auth", "AUTH", username)
+		res := Value{typ: "error", str: "WRONGPASS invalid username-password pair or user is disabled."}
+		e.server.audit.auth(e.client, username, res)
+		return res
+	}
+	e.client.lock.Lock()
+	e.client.user = u.name
+	e.client.lock.Unlock()
+	e.client.authenticated = true
+	res := Value{typ: "string", str: "OK"}
+	e.server.audit.auth(e.client, username, res)
+	return res
+}
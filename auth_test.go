@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequirePass(t *testing.T) {
+	server := newTestServer(t, "requirepass s3cret\n")
+	c := dialTestServer(t, server)
+
+	if res := c.do(t, "GET", "k"); res.typ != "error" || !strings.HasPrefix(res.str, "NOAUTH") {
+		t.Errorf("Expected NOAUTH before AUTH, got %v", res)
+	}
+	if res := c.do(t, "AUTH", "wrong"); res.typ != "error" || !strings.HasPrefix(res.str, "WRONGPASS") {
+		t.Errorf("Expected WRONGPASS, got %v", res)
+	}
+	if res := c.do(t, "AUTH", "admin", "s3cret"); res.typ != "error" {
+		t.Errorf("Expected an unknown user to be rejected, got %v", res)
+	}
+	if res := c.do(t, "AUTH", "default", "s3cret"); res.str != "OK" {
+		t.Errorf("Expected AUTH default to succeed, got %v", res)
+	}
+	if res := c.do(t, "GET", "k"); res.typ != "null" {
+		t.Errorf("Expected commands to run after AUTH, got %v", res)
+	}
+
+	other := dialTestServer(t, server)
+	if res := other.do(t, "AUTH", "s3cret"); res.str != "OK" {
+		t.Errorf("Expected the legacy AUTH form to succeed, got %v", res)
+	}
+}
+
+func TestAuthWithoutPassword(t *testing.T) {
+	server := newTestServer(t, "slowlog-log-slower-than 0\n")
+	c := dialTestServer(t, server)
+	if res := c.do(t, "AUTH", "x"); res.typ != "error" || !strings.Contains(res.str, "without any password configured") {
+		t.Errorf("Expected AUTH without requirepass to fail, got %v", res)
+	}
+	// the password never reaches the slow log
+	entry := c.do(t, "SLOWLOG", "GET", "1").array[0].array
+	if args := entry[3].array; args[1].bulk != "(redacted)" {
+		t.Errorf("Expected AUTH arguments to be redacted, got %v", args)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	u := newACLUser("alice")
+	u.applyRule(">abc")
+	if !u.checkPassword("abc") || u.checkPassword("abd") || u.checkPassword("abcd") {
+		t.Errorf("checkPassword gave a wrong answer")
+	}
+}
+
+func TestPasswordsRedactedFromLogs(t *testing.T) {
+	server := newTestServer(t, "slowlog-log-slower-than 0\n")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go server.handleConnection(peer)
+	reader := bufio.NewReader(conn)
+	conn.Write(command("MONITOR").Marshal())
+	reader.ReadString('\n')
+	for server.monitors.count.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	executor := server.newExecutor()
+	executor.handleCommand(command("CONFIG", "SET", "maxclients", "100", "requirepass", "s3cret"))
+	line, _ := reader.ReadString('\n')
+	if strings.Contains(line, "s3cret") || !strings.Contains(line, `"requirepass" "(redacted)"`) {
+		t.Errorf("Expected MONITOR to redact the password, got %q", line)
+	}
+	args := executor.handleCommand(command("SLOWLOG", "GET", "1")).array[0].array[3].array
+	if len(args) != 6 || args[3].bulk != "100" || args[5].bulk != "(redacted)" {
+		t.Errorf("Expected the slow log to redact the password, got %v", args)
+	}
+
+	reader.ReadString('\n') // the SLOWLOG GET
+	executor.handleCommand(command("ACL", "SETUSER", "alice", "on", ">hunter2", "#"+strings.Repeat("a", 64), "~*", "+get"))
+	line, _ = reader.ReadString('\n')
+	if strings.Contains(line, "hunter2") || !strings.HasSuffix(line, `"alice" "on" "(redacted)" "(redacted)" "~*" "+get"`+"\r\n") {
+		t.Errorf("Expected MONITOR to redact the password rules, got %q", line)
+	}
+	args = executor.handleCommand(command("SLOWLOG", "GET", "1")).array[0].array[3].array
+	if len(args) != 8 || args[4].bulk != "(redacted)" || args[5].bulk != "(redacted)" || args[6].bulk != "~*" {
+		t.Errorf("Expected the slow log to redact the password rules, got %v", args)
+	}
+}
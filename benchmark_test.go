@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"math/rand"
+	"net"
 	"testing"
 )
 
@@ -20,3 +22,123 @@ func BenchmarkSet(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkPipeline sends SETs in pipelines of pipelineDepth through a
+// connection, b.N counts commands
+func BenchmarkPipeline(b *testing.B) {
+	const pipelineDepth = 64
+	server := newTestServer(b, "")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go server.handleConnection(peer)
+	parser := &RespParser{reader: bufio.NewReader(conn)}
+	var pipeline []byte
+	for i := 0; i < pipelineDepth; i++ {
+		pipeline = append(pipeline, command("SET", fmt.Sprintf("key-%d", i), "value").Marshal()...)
+	}
+
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += pipelineDepth {
+		conn.Write(pipeline)
+		for i := 0; i < pipelineDepth; i++ {
+			if _, err := parser.readResp(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// repeatReader returns data over and over
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// benchmarkCommands are the requests of the per-command benchmarks, with
+// the reply each one gets once the keys were set
+var benchmarkCommands = []struct {
+	name  string
+	args  []string
+	reply Value
+}{
+	{"GET", []string{"GET", "key:1"}, Value{typ: "bulk", bulk: "value"}},
+	{"SET", []string{"SET", "key:1", "value"}, Value{typ: "string", str: "OK"}},
+	{"MGET", []string{"MGET", "key:1", "key:2", "key:3", "key:4"}, Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "value"}, {typ: "bulk", bulk: "value"}, {typ: "bulk", bulk: "value"}, {typ: "bulk", bulk: "value"},
+	}}},
+}
+
+// BenchmarkReadArgs parses requests without copying their arguments
+func BenchmarkReadArgs(b *testing.B) {
+	for _, bc := range benchmarkCommands {
+		b.Run(bc.name, func(b *testing.B) {
+			parser := newRespParser(&repeatReader{data: command(bc.args...).Marshal()})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.readArgs(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadCommand parses requests into Values for the executor. GET
+// and MGET borrow their arguments, SET allocates the arguments' array plus
+// one string per argument.
+func BenchmarkReadCommand(b *testing.B) {
+	for _, bc := range benchmarkCommands {
+		b.Run(bc.name, func(b *testing.B) {
+			parser := newRespParser(&repeatReader{data: command(bc.args...).Marshal()})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.readCommand(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeReply encodes replies into a reused buffer
+func BenchmarkEncodeReply(b *testing.B) {
+	for _, bc := range benchmarkCommands {
+		b.Run(bc.name, func(b *testing.B) {
+			var buffer []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buffer = bc.reply.appendRESP(buffer[:0], 2)
+			}
+		})
+	}
+}
+
+// BenchmarkCommand parses, executes and encodes the reply of a command,
+// reporting the allocations of the whole request
+func BenchmarkCommand(b *testing.B) {
+	server := newTestServer(b, "")
+	executor := server.newExecutor()
+	for i := 1; i <= 4; i++ {
+		executor.handleCommand(command("SET", fmt.Sprintf("key:%d", i), "value"))
+	}
+	for _, bc := range benchmarkCommands {
+		b.Run(bc.name, func(b *testing.B) {
+			parser := newRespParser(&repeatReader{data: command(bc.args...).Marshal()})
+			var buffer []byte
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				val, err := parser.readCommand()
+				if err != nil {
+					b.Fatal(err)
+				}
+				buffer = executor.handleCommand(val).appendRESP(buffer[:0], 2)
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client is the server side state of a connection
+type Client struct {
+	id        int64
+	addr      string
+	laddr     string
+	conn      net.Conn
+	createdAt time.Time
+	// connected over the unix socket
+	unixSocket bool
+
+	// everything below can be read by other connections (CLIENT LIST)
+	lock    sync.Mutex
+	name    string
+	libName string
+	libVer  string
+	user    string
+	// RESP version negotiated with HELLO, 2 or 3
+	protocol int
+	db       int
+	// full name of the last command, e.g. client|list
+	lastCmd         string
+	lastInteraction time.Time
+	// unread bytes in the query buffer and its capacity, after the last read
+	queryBuf     int
+	queryBufSize int
+	// bytes taken by the arguments of the last command
+	argvMem int
+	// bytes of the last reply
+	lastReply int
+	noEvict   bool
+	noTouch   bool
+	monitor   bool
+
+	// waiting on CLIENT PAUSE, such clients aren't closed for being idle
+	blocked atomic.Bool
+	// closed once the client is killed or hangs up, wakes a blocked command
+	done      chan struct{}
+	closeOnce sync.Once
+	// called by a command about to block, returns a func to call once it
+	// resumes. Set by the connection goroutine.
+	onBlock func() func()
+
+	// only touched by the connection's own goroutine
+	authenticated bool
+
+	// set by CLIENT KILL on the killing connection itself, the reply is sent
+	// before the connection is closed
+	closeAfterReply atomic.Bool
+}
+
+// last client ID handed out, IDs are never reused
+var lastClientID atomic.Int64
+
+func newClient(conn net.Conn) *Client {
+	now := time.Now()
+	c := &Client{
+		id:              lastClientID.Add(1),
+		conn:            conn,
+		createdAt:       now,
+		lastInteraction: now,
+		user:            "default",
+		protocol:        2,
+		done:            make(chan struct{}),
+	}
+	if conn.LocalAddr().Network() == "unix" {
+		// the peer of a unix socket has no address, Redis shows the path
+		c.unixSocket = true
+		c.addr = conn.LocalAddr().String() + ":0"
+		c.laddr = c.addr
+	} else {
+		c.addr = conn.RemoteAddr().String()
+		c.laddr = conn.LocalAddr().String()
+	}
+	return c
+}
+
+// close disconnects the client, waking it up if it's blocked
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.conn.Close()
+}
+
+// clientName returns the name set with CLIENT SETNAME
+func (c *Client) clientName() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.name
+}
+
+// userName returns the ACL user the client is authenticated as
+func (c *Client) userName() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.user
+}
+
+// recordQuery updates the client after a command was read
+func (c *Client) recordQuery(input Value, buffered int, size int) {
+	argvMem := 0
+	for _, arg := range input.array {
+		argvMem += len(arg.bulk)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastInteraction = time.Now()
+	c.queryBuf = buffered
+	c.queryBufSize = size
+	c.argvMem = argvMem
+}
+
+// recordCommand remembers the command the client ran last
+func (c *Client) recordCommand(spec *commandSpec, input Value) {
+	name := "NULL"
+	if spec != nil {
+		name = commandFullName(spec, input)
+	}
+	c.lock.Lock()
+	c.lastCmd = name
+	c.lock.Unlock()
+}
+
+func (c *Client) recordReply(n int) {
+	c.lock.Lock()
+	c.lastReply = n
+	c.lastInteraction = time.Now()
+	c.lock.Unlock()
+}
+
+// commandFullName names a command the way Redis reports it, with the
+// subcommand for container commands like CLIENT and CONFIG
+func commandFullName(spec *commandSpec, input Value) string {
+	if spec.flags&cmdContainer != 0 && len(input.array) > 1 {
+		return spec.name + "|" + strings.ToLower(input.array[1].bulk)
+	}
+	return spec.name
+}
+
+// info formats the client as a CLIENT LIST / CLIENT INFO line
+func (c *Client) info() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	flags := "N"
+	if c.monitor {
+		flags = "O"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if c.noTouch {
+		flags += "T"
+	}
+	if c.unixSocket {
+		flags += "U"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=0 psub=0 ssub=0 multi=-1 "+
+		"qbuf=%d qbuf-free=%d argv-mem=%d multi-mem=0 obl=%d oll=0 omem=0 tot-mem=%d cmd=%s user=%s redir=-1 resp=%d lib-name=%s lib-ver=%s",
+		c.id, c.addr, c.laddr, c.name, int64(now.Sub(c.createdAt).Seconds()), int64(now.Sub(c.lastInteraction).Seconds()),
+		flags, c.db, c.queryBuf, c.queryBufSize-c.queryBuf, c.argvMem, c.lastReply,
+		c.queryBufSize+c.argvMem+c.lastReply, c.lastCmd, c.user, c.protocol, c.libName, c.libVer)
+}
+
+// clientRegistry tracks the connected clients by ID
+type clientRegistry struct {
+	lock    sync.RWMutex
+	clients map[int64]*Client
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[int64]*Client)}
+}
+
+func (r *clientRegistry) add(c *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clients[c.id] = c
+}
+
+func (r *clientRegistry) remove(c *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.clients, c.id)
+}
+
+// list returns the clients ordered by ID
+func (r *clientRegistry) list() []*Client {
+	r.lock.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.lock.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// client types accepted by CLIENT LIST TYPE and CLIENT KILL TYPE. Every
+// connection is a normal client, the others exist for compatibility.
+var clientTypes = []string{"normal", "master", "replica", "slave", "pubsub"}
+
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Executor) handleClientCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client' command"}
+	}
+	if e.server == nil || e.client == nil {
+		return Value{typ: "error", str: "ERR CLIENT is not available"}
+	}
+	subcommand := strings.ToUpper(array[0].bulk)
+	args := array[1:]
+	wrongArgs := Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for 'client|%s' command", strings.ToLower(subcommand))}
+	c := e.client
+	switch subcommand {
+	case "ID":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		return Value{typ: "integer", num: int(c.id)}
+	case "GETNAME":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		if name := c.clientName(); name != "" {
+			return Value{typ: "bulk", bulk: name}
+		}
+		return Value{typ: "null"}
+	case "SETNAME":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		if !validClientName(args[0].bulk) {
+			return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+		c.lock.Lock()
+		c.name = args[0].bulk
+		c.lock.Unlock()
+		return Value{typ: "string", str: "OK"}
+	case "SETINFO":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		attr, val := strings.ToUpper(args[0].bulk), args[1].bulk
+		if attr != "LIB-NAME" && attr != "LIB-VER" {
+			return Value{typ: "error", str: fmt.Sprintf("ERR Unrecognized option '%s'", args[0].bulk)}
+		}
+		if !validClientName(val) {
+			return Value{typ: "error", str: fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", strings.ToLower(attr))}
+		}
+		c.lock.Lock()
+		if attr == "LIB-NAME" {
+			c.libName = val
+		} else {
+			c.libVer = val
+		}
+		c.lock.Unlock()
+		return Value{typ: "string", str: "OK"}
+	case "INFO":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		return Value{typ: "verbatim", str: "txt", bulk: c.info() + "\n"}
+	case "LIST":
+		return e.server.clientList(args)
+	case "KILL":
+		return e.server.clientKill(c, args)
+	case "NO-EVICT", "NO-TOUCH":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		var on bool
+		switch strings.ToUpper(args[0].bulk) {
+		case "ON":
+			on = true
+		case "OFF":
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		c.lock.Lock()
+		if subcommand == "NO-EVICT" {
+			c.noEvict = on
+		} else {
+			c.noTouch = on
+		}
+		c.lock.Unlock()
+		return Value{typ: "string", str: "OK"}
+	case "PAUSE":
+		if len(args) < 1 || len(args) > 2 {
+			return wrongArgs
+		}
+		timeout, err := strconv.ParseInt(args[0].bulk, 10, 64)
+		if err != nil || timeout < 0 {
+			return Value{typ: "error", str: "ERR timeout is not an integer or out of range"}
+		}
+		mode := pauseAll
+		if len(args) == 2 {
+			switch strings.ToUpper(args[1].bulk) {
+			case "WRITE":
+				mode = pauseWrite
+			case "ALL":
+			default:
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+		}
+		e.server.pause.pause(mode, time.Duration(timeout)*time.Millisecond)
+		return Value{typ: "string", str: "OK"}
+	case "UNPAUSE":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		e.server.pause.unpause()
+		return Value{typ: "string", str: "OK"}
+	case "UNBLOCK":
+		if len(args) < 1 || len(args) > 2 {
+			return wrongArgs
+		}
+		// no command blocks, so there's never a client to unblock
+		if _, err := strconv.ParseInt(args[0].bulk, 10, 64); err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		return Value{typ: "integer", num: 0}
+	case "GETREDIR":
+		if len(args) != 0 {
+			return wrongArgs
+		}
+		// client side caching isn't supported
+		return Value{typ: "integer", num: -1}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", array[0].bulk)}
+	}
+}
+
+// clientList handles CLIENT LIST [TYPE type] [ID id ...]
+func (s *Server) clientList(args []Value) Value {
+	var ids map[int64]bool
+	typ := ""
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			i++
+			typ = strings.ToLower(args[i].bulk)
+			if !slices.Contains(clientTypes, typ) {
+				return Value{typ: "error", str: fmt.Sprintf("ERR Unknown client type '%s'", args[i].bulk)}
+			}
+		case "ID":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(args[i].bulk, 10, 64)
+				if err != nil || id <= 0 {
+					return Value{typ: "error", str: "ERR Invalid client ID"}
+				}
+				ids[id] = true
+			}
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	var sb strings.Builder
+	for _, c := range s.clients.list() {
+		if typ != "" && typ != "normal" {
+			continue
+		}
+		if ids != nil && !ids[c.id] {
+			continue
+		}
+		sb.WriteString(c.info())
+		sb.WriteByte('\n')
+	}
+	return Value{typ: "verbatim", str: "txt", bulk: sb.String()}
+}
+
+// clientKillFilter selects the clients CLIENT KILL closes
+type clientKillFilter struct {
+	id     int64
+	addr   string
+	laddr  string
+	user   string
+	typ    string
+	maxAge int64
+	skipMe bool
+}
+
+func (f *clientKillFilter) matches(c *Client, self *Client) bool {
+	if f.skipMe && c == self {
+		return false
+	}
+	c.lock.Lock()
+	user := c.user
+	c.lock.Unlock()
+	return (f.id == 0 || c.id == f.id) &&
+		(f.addr == "" || c.addr == f.addr) &&
+		(f.laddr == "" || c.laddr == f.laddr) &&
+		(f.user == "" || user == f.user) &&
+		(f.typ == "" || f.typ == "normal") &&
+		(f.maxAge == 0 || int64(time.Since(c.createdAt).Seconds()) >= f.maxAge)
+}
+
+// clientKill handles both the old CLIENT KILL addr form, which replies OK or
+// an error, and the filter form, which replies with the number of clients
+// killed
+func (s *Server) clientKill(self *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|kill' command"}
+	}
+	if len(args) == 1 {
+		filter := &clientKillFilter{addr: args[0].bulk}
+		if s.killClients(filter, self) == 0 {
+			return Value{typ: "error", str: "ERR No such client"}
+		}
+		return Value{typ: "string", str: "OK"}
+	}
+	filter, err := parseClientKillFilter(args)
+	if err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "integer", num: s.killClients(filter, self)}
+}
+
+func parseClientKillFilter(args []Value) (*clientKillFilter, error) {
+	if len(args)%2 != 0 {
+		return nil, errors.New("syntax error")
+	}
+	// like Redis, the filter form skips the calling client unless asked not to
+	filter := &clientKillFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1].bulk
+		switch strings.ToUpper(args[i].bulk) {
+		case "ID":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, errors.New("client-id should be greater than 0")
+			}
+			filter.id = id
+		case "ADDR":
+			filter.addr = val
+		case "LADDR":
+			filter.laddr = val
+		case "USER":
+			filter.user = val
+		case "TYPE":
+			filter.typ = strings.ToLower(val)
+			if !slices.Contains(clientTypes, filter.typ) {
+				return nil, fmt.Errorf("Unknown client type '%s'", val)
+			}
+		case "SKIPME":
+			switch strings.ToLower(val) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return nil, errors.New("syntax error")
+			}
+		case "MAXAGE":
+			age, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || age <= 0 {
+				return nil, errors.New("value is not an integer or out of range")
+			}
+			filter.maxAge = age
+		default:
+			return nil, errors.New("syntax error")
+		}
+	}
+	return filter, nil
+}
+
+// killClients closes every matching client and returns how many there were.
+// The calling client is closed after its reply is written.
+func (s *Server) killClients(filter *clientKillFilter, self *Client) int {
+	killed := 0
+	for _, c := range s.clients.list() {
+		if !filter.matches(c, self) {
+			continue
+		}
+		killed++
+		if c == self {
+			c.closeAfterReply.Store(true)
+			continue
+		}
+		c.close()
+	}
+	return killed
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConn is a client connected to server.handleConnection over a pipe
+type testConn struct {
+	conn   net.Conn
+	parser *RespParser
+}
+
+func dialTestServer(t *testing.T, server *Server) *testConn {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	go server.handleConnection(peer)
+	return &testConn{conn: conn, parser: &RespParser{reader: bufio.NewReader(conn)}}
+}
+
+func (c *testConn) do(t *testing.T, args ...string) Value {
+	t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(command(args...).Marshal()); err != nil {
+		t.Fatalf("Failed to send %v: %v", args, err)
+	}
+	res, err := c.parser.readResp()
+	if err != nil {
+		t.Fatalf("Failed to read the reply to %v: %v", args, err)
+	}
+	return res
+}
+
+// writeCountingConn counts the writes made to a connection
+type writeCountingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c writeCountingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestPipelinedRepliesAreBatched(t *testing.T) {
+	server := newTestServer(t, "")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	var writes atomic.Int64
+	go server.handleConnection(writeCountingConn{Conn: peer, writes: &writes})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	parser := &RespParser{reader: bufio.NewReader(conn)}
+
+	var pipeline []byte
+	for i := 0; i < 100; i++ {
+		pipeline = append(pipeline, command("SET", "key"+strconv.Itoa(i), "value").Marshal()...)
+	}
+	conn.Write(pipeline)
+	for i := 0; i < 100; i++ {
+		if res, err := parser.readResp(); err != nil || res.str != "OK" {
+			t.Fatalf("Expected OK for command %d, got %v (%v)", i, res, err)
+		}
+	}
+	if n := writes.Load(); n != 1 {
+		t.Errorf("Expected the pipeline to be answered with one write, got %d", n)
+	}
+
+	// replies buffered before QUIT are still sent
+	conn.Write(append(command("GET", "key99").Marshal(), command("QUIT").Marshal()...))
+	if res, err := parser.readResp(); err != nil || res.bulk != "value" {
+		t.Errorf("Expected value, got %v (%v)", res, err)
+	}
+	if _, err := parser.readResp(); err == nil {
+		t.Errorf("Expected the connection to be closed after QUIT")
+	}
+	if n := server.stats.netOutputBytes.Load(); n != int64(100*5+len("$5\r\nvalue\r\n")) {
+		t.Errorf("Expected every reply to be counted in the output bytes, got %d", n)
+	}
+}
+
+func TestClientNameAndInfo(t *testing.T) {
+	server := newTestServer(t, "")
+	c := dialTestServer(t, server)
+
+	if res := c.do(t, "CLIENT", "GETNAME"); res.typ != "null" {
+		t.Errorf("Expected no name, got %v", res)
+	}
+	if res := c.do(t, "CLIENT", "SETNAME", "bad name"); res.typ != "error" {
+		t.Errorf("Expected names with spaces to be rejected")
+	}
+	c.do(t, "CLIENT", "SETNAME", "worker")
+	c.do(t, "CLIENT", "SETINFO", "LIB-NAME", "go-redis")
+	if res := c.do(t, "CLIENT", "GETNAME"); res.bulk != "worker" {
+		t.Errorf("Expected worker, got %v", res)
+	}
+	info := c.do(t, "CLIENT", "INFO").bulk
+	for _, field := range []string{" name=worker ", " lib-name=go-redis ", " cmd=client|info ", " user=default ", " db=0 "} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected CLIENT INFO to contain %q, got %q", field, info)
+		}
+	}
+}
+
+func TestClientListAndKill(t *testing.T) {
+	server := newTestServer(t, "")
+	a := dialTestServer(t, server)
+	b := dialTestServer(t, server)
+	idA := a.do(t, "CLIENT", "ID").num
+	idB := b.do(t, "CLIENT", "ID").num
+
+	list := a.do(t, "CLIENT", "LIST").bulk
+	if strings.Count(list, "\n") != 2 {
+		t.Errorf("Expected 2 clients, got %q", list)
+	}
+	list = a.do(t, "CLIENT", "LIST", "ID", "999999").bulk
+	if list != "" {
+		t.Errorf("Expected no client with ID 999999, got %q", list)
+	}
+
+	// the filter form skips the caller by default
+	if res := a.do(t, "CLIENT", "KILL", "TYPE", "normal"); res.num != 1 {
+		t.Errorf("Expected 1 client killed, got %v", res)
+	}
+	b.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.parser.readResp(); err == nil {
+		t.Errorf("Expected client %d to be disconnected", idB)
+	}
+
+	// killing yourself still gets the reply
+	if res := a.do(t, "CLIENT", "KILL", "ID", strconv.Itoa(idA), "SKIPME", "no"); res.num != 1 {
+		t.Errorf("Expected the caller to be killed, got %v", res)
+	}
+	if _, err := a.parser.readResp(); err == nil {
+		t.Errorf("Expected client %d to be disconnected", idA)
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+	first := dialTestServer(t, server)
+	second := dialTestServer(t, server)
+
+	admin.do(t, "CLIENT", "PAUSE", "10000", "WRITE")
+	first.conn.Write(command("SET", "k", "1").Marshal())
+	for len(heldCommands(server)) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	second.conn.Write(command("SET", "k", "2").Marshal())
+	for len(heldCommands(server)) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// reads keep being served while writes are held
+	if res := admin.do(t, "GET", "k"); res.typ != "null" {
+		t.Errorf("Expected k to be unset while paused, got %v", res)
+	}
+
+	admin.do(t, "CLIENT", "UNPAUSE")
+	for _, c := range []*testConn{first, second} {
+		if res, err := c.parser.readResp(); err != nil || res.str != "OK" {
+			t.Errorf("Expected the held SET to complete, got %v %v", res, err)
+		}
+	}
+	// held commands run in the order they arrived
+	if res := admin.do(t, "GET", "k"); res.bulk != "2" {
+		t.Errorf("Expected the second SET to run last, got %v", res)
+	}
+
+	admin.do(t, "CLIENT", "PAUSE", "50", "ALL")
+	start := time.Now()
+	first.do(t, "GET", "k")
+	if time.Since(start) < 40*time.Millisecond {
+		t.Errorf("Expected GET to be held until the pause expired")
+	}
+}
+
+func TestClientPauseDropsDisconnectedClients(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+	killed := dialTestServer(t, server)
+	kept := dialTestServer(t, server)
+	hungUp := dialTestServer(t, server)
+	killedID := killed.do(t, "CLIENT", "ID").num
+
+	admin.do(t, "CLIENT", "PAUSE", "10000", "WRITE")
+	for i, c := range []*testConn{killed, kept, hungUp} {
+		c.conn.Write(command("SET", "k", strconv.Itoa(i)).Marshal())
+		for len(heldCommands(server)) < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	admin.do(t, "CLIENT", "KILL", "ID", strconv.Itoa(killedID))
+	hungUp.conn.Close()
+	// both leave the queue without waiting for the pause to end
+	deadline := time.Now().Add(5 * time.Second)
+	for len(heldCommands(server)) > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if held := len(heldCommands(server)); held != 1 {
+		t.Fatalf("Expected only the connected client to stay held, got %d", held)
+	}
+
+	admin.do(t, "CLIENT", "UNPAUSE")
+	if res, err := kept.parser.readResp(); err != nil || res.str != "OK" {
+		t.Errorf("Expected the held SET to complete, got %v %v", res, err)
+	}
+	if res := admin.do(t, "GET", "k"); res.bulk != "1" {
+		t.Errorf("Expected the dropped SETs not to run, got %v", res)
+	}
+}
+
+func TestClientPauseFlushesEarlierReplies(t *testing.T) {
+	server := newTestServer(t, "")
+	admin := dialTestServer(t, server)
+	client := dialTestServer(t, server)
+	admin.do(t, "SET", "k", "old")
+
+	admin.do(t, "CLIENT", "PAUSE", "10000", "WRITE")
+	pipeline := append(command("GET", "k").Marshal(), command("SET", "k", "new").Marshal()...)
+	client.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client.conn.Write(pipeline)
+	// the GET is answered while the SET is still held
+	if res, err := client.parser.readResp(); err != nil || res.bulk != "old" {
+		t.Errorf("Expected the GET reply before the pause ends, got %v %v", res, err)
+	}
+	if held := len(heldCommands(server)); held != 1 {
+		t.Errorf("Expected the SET to be held, got %d held commands", held)
+	}
+
+	admin.do(t, "CLIENT", "UNPAUSE")
+	if res, err := client.parser.readResp(); err != nil || res.str != "OK" {
+		t.Errorf("Expected the held SET to complete, got %v %v", res, err)
+	}
+}
+
+func TestPauseStaleTimer(t *testing.T) {
+	var p pauseState
+	p.pause(pauseWrite, time.Hour)
+	p.lock.Lock()
+	stale := p.generation
+	p.lock.Unlock()
+	// a new pause supersedes the timer of the first one
+	p.pause(pauseAll, time.Hour)
+	p.expire(stale)
+	if mode := p.modeName(); mode != "all" {
+		t.Errorf("Expected a stale timer to leave the pause alone, got %q", mode)
+	}
+	p.lock.Lock()
+	current := p.generation
+	p.lock.Unlock()
+	p.expire(current)
+	if mode := p.modeName(); mode != "none" {
+		t.Errorf("Expected the current timer to end the pause, got %q", mode)
+	}
+}
+
+func heldCommands(server *Server) []chan struct{} {
+	server.pause.lock.Lock()
+	defer server.pause.lock.Unlock()
+	return server.pause.queue
+}
+
+func TestReplyWriterReleasesBuffer(t *testing.T) {
+	var out strings.Builder
+	writer := &replyWriter{w: &out}
+	writer.write(Value{typ: "string", str: "OK"}, 2)
+	writer.write(Value{typ: "integer", num: 1}, 2)
+	if out.Len() != 0 || writer.buffer == nil {
+		t.Fatalf("Expected replies to be buffered until flushed, got %q", out.String())
+	}
+	if err := writer.flush(); err != nil || out.String() != "+OK\r\n:1\r\n" {
+		t.Errorf("Expected both replies in one write, got %q (%v)", out.String(), err)
+	}
+	// idle connections don't hold a buffer
+	if writer.buffer != nil {
+		t.Errorf("Expected the buffer to go back to the pool after flushing")
+	}
+	// a pipeline bigger than the buffer is written as it fills
+	big := Value{typ: "bulk", bulk: strings.Repeat("x", replyBufferSize)}
+	writer.write(big, 2)
+	if out.Len() <= replyBufferSize || writer.buffer != nil {
+		t.Errorf("Expected a full buffer to be written right away, got %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import "strings"
+
+// command flags describing how a command interacts with the dataset
+const (
+	// command modifies the dataset
+	cmdWrite = 1 << iota
+	// command only reads the dataset
+	cmdReadonly
+	// command is allowed while the dataset is loading
+	cmdLoading
+	// command takes a subcommand as its first argument, e.g. CONFIG GET
+	cmdContainer
+	// command may run before the client authenticated
+	cmdNoAuth
+	// arguments hold secrets, the slow log and MONITOR only see them redacted
+	cmdSensitive
+	// arguments are done with once the reply is built, so the parser passes
+	// them without copying
+	cmdNoRetain
+)
+
+// ACL categories, bit i is named aclCategoryNames[i]
+const (
+	catKeyspace = 1 << iota
+	catRead
+	catWrite
+	catString
+	catFast
+	catSlow
+	catAdmin
+	catDangerous
+	catConnection
+	catPubsub
+)
+
+var aclCategoryNames = []string{"keyspace", "read", "write", "string", "fast", "slow", "admin", "dangerous", "connection", "pubsub"}
+
+// commandSpec describes a command. Key positions follow Redis' convention:
+// firstKey and lastKey index into the full argument list (command name at 0),
+// a negative lastKey counts from the end and step skips over values.
+type commandSpec struct {
+	name     string
+	flags    int
+	firstKey int
+	lastKey  int
+	step     int
+	// ACL categories
+	acl int
+}
+
+var commandTable = map[string]*commandSpec{
+	"PING":    {name: "ping", acl: catFast | catConnection},
+	"QUIT":    {name: "quit", flags: cmdLoading | cmdNoAuth, acl: catFast | catConnection},
+	"AUTH":    {name: "auth", flags: cmdLoading | cmdNoAuth | cmdSensitive, acl: catFast | catConnection},
+	"HELLO":   {name: "hello", flags: cmdLoading | cmdNoAuth | cmdSensitive, acl: catFast | catConnection},
+	"COMMAND": {name: "command", flags: cmdLoading, acl: catSlow | catConnection},
+	"INFO":    {name: "info", flags: cmdLoading, acl: catSlow | catDangerous},
+	"CONFIG":  {name: "config", flags: cmdLoading | cmdContainer, acl: catAdmin | catSlow | catDangerous},
+	"DEBUG":   {name: "debug", flags: cmdLoading | cmdContainer, acl: catAdmin | catSlow | catDangerous},
+	"SLOWLOG": {name: "slowlog", flags: cmdLoading | cmdContainer, acl: catAdmin | catSlow | catDangerous},
+	"LATENCY": {name: "latency", flags: cmdLoading | cmdContainer, acl: catAdmin | catSlow | catDangerous},
+	"CLIENT":  {name: "client", flags: cmdLoading | cmdContainer, acl: catSlow | catConnection},
+	"ACL":     {name: "acl", flags: cmdLoading | cmdContainer, acl: catAdmin | catSlow | catDangerous},
+	"MONITOR": {name: "monitor", flags: cmdLoading, acl: catAdmin | catSlow | catDangerous},
+	"GET":     {name: "get", flags: cmdReadonly | cmdNoRetain, firstKey: 1, lastKey: 1, step: 1, acl: catRead | catString | catFast},
+	"MGET":    {name: "mget", flags: cmdReadonly | cmdNoRetain, firstKey: 1, lastKey: -1, step: 1, acl: catRead | catString | catFast},
+	"KEYS":    {name: "keys", flags: cmdReadonly, acl: catKeyspace | catRead | catSlow | catDangerous},
+	"SET":     {name: "set", flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, acl: catWrite | catString | catSlow},
+	"SETNX":   {name: "setnx", flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, acl: catWrite | catString | catFast},
+	"MSET":    {name: "mset", flags: cmdWrite, firstKey: 1, lastKey: -1, step: 2, acl: catWrite | catString | catSlow},
+	"INCR":    {name: "incr", flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, acl: catWrite | catString | catFast},
+	"DECR":    {name: "decr", flags: cmdWrite, firstKey: 1, lastKey: 1, step: 1, acl: catWrite | catString | catFast},
+	"DEL":     {name: "del", flags: cmdWrite, firstKey: 1, lastKey: -1, step: 1, acl: catKeyspace | catWrite | catSlow},
+	"RENAME":  {name: "rename", flags: cmdWrite, firstKey: 1, lastKey: 2, step: 1, acl: catKeyspace | catWrite | catSlow},
+	"FLUSHDB": {name: "flushdb", flags: cmdWrite, acl: catKeyspace | catWrite | catSlow | catDangerous},
+}
+
+// subcommands whose ACL categories differ from their container command's
+var subcommandACL = map[string]int{
+	"client|kill":     catAdmin | catSlow | catDangerous | catConnection,
+	"client|list":     catAdmin | catSlow | catDangerous | catConnection,
+	"client|pause":    catAdmin | catSlow | catDangerous | catConnection,
+	"client|unpause":  catAdmin | catSlow | catDangerous | catConnection,
+	"client|no-evict": catAdmin | catSlow | catDangerous | catConnection,
+	"acl|whoami":      catSlow,
+	"acl|cat":         catSlow,
+}
+
+// lookupCommand expects an upper-cased command name
+func lookupCommand(name string) *commandSpec {
+	return commandTable[name]
+}
+
+// lookupCommandBytes is lookupCommand for a name still in the parser's
+// buffer, upper-cased on the stack so it doesn't allocate
+func lookupCommandBytes(name []byte) *commandSpec {
+	var upper [16]byte
+	if len(name) > len(upper) {
+		return nil
+	}
+	for i, c := range name {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper[i] = c
+	}
+	return commandTable[string(upper[:len(name)])]
+}
+
+func (c *commandSpec) allowedWhileLoading() bool {
+	return c != nil && c.flags&cmdLoading != 0
+}
+
+func (c *commandSpec) allowedBeforeAuth() bool {
+	return c != nil && c.flags&cmdNoAuth != 0
+}
+
+func (c *commandSpec) isWrite() bool {
+	return c != nil && c.flags&cmdWrite != 0
+}
+
+// loggable returns the command as the slow log, MONITOR and the audit log
+// may show it, with passwords redacted
+func (c *commandSpec) loggable(input Value) Value {
+	if c == nil {
+		return input
+	}
+	if c.flags&cmdSensitive != 0 {
+		return redactArgs(input, func(i int) bool { return i > 0 })
+	}
+	switch commandFullName(c, input) {
+	case "config|set":
+		// the value following requirepass
+		return redactArgs(input, func(i int) bool {
+			return i > 2 && i%2 == 1 && strings.EqualFold(input.array[i-1].bulk, "requirepass")
+		})
+	case "acl|setuser":
+		// password rules: >password, <password, #hash and !hash
+		return redactArgs(input, func(i int) bool {
+			rule := input.array[i].bulk
+			return i > 2 && rule != "" && strings.ContainsRune("><#!", rune(rule[0]))
+		})
+	}
+	return input
+}
+
+// redactArgs returns input with the arguments secret matches replaced,
+// copying it only if there are any
+func redactArgs(input Value, secret func(i int) bool) Value {
+	var redacted Value
+	for i := range input.array {
+		if !secret(i) {
+			continue
+		}
+		if redacted.array == nil {
+			redacted = Value{typ: "array", array: append([]Value(nil), input.array...)}
+		}
+		redacted.array[i] = Value{typ: "bulk", bulk: "(redacted)"}
+	}
+	if redacted.array == nil {
+		return input
+	}
+	return redacted
+}
+
+// keys returns the key arguments of a command, args includes the command name
+func (c *commandSpec) keys(args []Value) []string {
+	if c == nil || c.firstKey == 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	keys := []string{}
+	for i := c.firstKey; i <= last && i < len(args); i += c.step {
+		keys = append(keys, args[i].bulk)
+	}
+	return keys
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config holds the server settings. After startup it's shared by every
+// connection, so reads and CONFIG SET go through lock.
+type Config struct {
+	lock           sync.RWMutex
+	bind           []string
+	port           int
+	shards         int
+	dir            string
+	appendfilename string
+	appendfsync    string
+	aofSharded     bool
+	aofKeyFile     string
+	maxclients     int
+	loglevel       string
+	logfile        string
+	metricsPort    int
+	slowlogSlower  int
+	slowlogMaxLen  int
+	latencyMonitor int
+	requirepass    string
+	aclfile        string
+	acllogMaxLen   int
+	auditLogfile   string
+	tlsPort        int
+	tlsCertFile    string
+	tlsKeyFile     string
+	tlsCACertFile  string
+	tlsAuthClients string
+	tlsMinVersion  string
+	tlsCiphers     string
+	unixsocket     string
+	unixsocketperm int
+	protectedMode  bool
+	timeout        int
+	tcpKeepalive   int
+	protoMaxBulk   int
+}
+
+// configOption is a redis.conf directive, also accepted as a --name flag.
+// configOptions is the registry CONFIG GET/SET/REWRITE work from.
+type configOption struct {
+	name  string
+	usage string
+	// set parses and validates the directive's arguments
+	set func(c *Config, args []string) error
+	get func(c *Config) string
+	// whether CONFIG SET may change the option at runtime
+	mutable bool
+	// pushes a changed value to the component using it, runs with the
+	// config lock held
+	apply func(s *Server) error
+}
+
+var configOptions = []*configOption{
+	listConfig("bind", "addresses to listen on, empty for all interfaces. A leading - skips an address that isn't available", func(c *Config) *[]string { return &c.bind }),
+	stringConfig("unixsocket", "path of a unix socket to listen on, empty to disable", func(c *Config) *string { return &c.unixsocket }),
+	octalConfig("unixsocketperm", "permissions of the unix socket in octal, 0 to keep the umask default", func(c *Config) *int { return &c.unixsocketperm }),
+	intConfig("port", "TCP port to listen on, 0 to only accept TLS connections", 0, 65535, func(c *Config) *int { return &c.port }),
+	intConfig("tls-port", "TCP port accepting TLS connections, 0 to disable", 0, 65535, func(c *Config) *int { return &c.tlsPort }),
+	live(stringConfig("tls-cert-file", "certificate the TLS port presents, PEM encoded", func(c *Config) *string { return &c.tlsCertFile }), applyTLS),
+	live(stringConfig("tls-key-file", "private key of tls-cert-file, PEM encoded", func(c *Config) *string { return &c.tlsKeyFile }), applyTLS),
+	live(stringConfig("tls-ca-cert-file", "CA certificates client certificates are verified against", func(c *Config) *string { return &c.tlsCACertFile }), applyTLS),
+	live(enumConfig("tls-auth-clients", "whether TLS clients must present a certificate: yes, no or optional", []string{"yes", "no", "optional"}, func(c *Config) *string { return &c.tlsAuthClients }), applyTLS),
+	live(enumConfig("tls-min-version", "oldest TLS version accepted: TLSv1.2 or TLSv1.3", []string{"tlsv1.2", "tlsv1.3"}, func(c *Config) *string { return &c.tlsMinVersion }), applyTLS),
+	live(stringConfig("tls-ciphers", "colon separated TLS 1.2 cipher suites, empty for Go's defaults", func(c *Config) *string { return &c.tlsCiphers }), applyTLS),
+	intConfig("shards", "number of keyspace shards, each with its own lock", 1, 1<<16, func(c *Config) *int { return &c.shards }),
+	stringConfig("dir", "working directory for the AOF", func(c *Config) *string { return &c.dir }),
+	stringConfig("appendfilename", "name of the AOF inside dir", func(c *Config) *string { return &c.appendfilename }),
+	live(enumConfig("appendfsync", "when to fsync the AOF: always, everysec or no", []string{"always", "everysec", "no"}, func(c *Config) *string { return &c.appendfsync }), applyAppendfsync),
+	boolConfig("aof-sharded", "write one AOF segment per shard and replay them in parallel", func(c *Config) *bool { return &c.aofSharded }),
+	stringConfig("aof-encryption-key-file", "file holding the AOF encryption key (32 bytes or 64 hex characters)", func(c *Config) *string { return &c.aofKeyFile }),
+	live(intConfig("maxclients", "maximum number of connected clients", 1, 1<<20, func(c *Config) *int { return &c.maxclients }), nil),
+	live(intConfig("timeout", "close clients idle for this many seconds, 0 to never close them", 0, 1<<31-1, func(c *Config) *int { return &c.timeout }), nil),
+	live(intConfig("tcp-keepalive", "seconds of inactivity before TCP keepalive probes are sent, 0 to disable", 0, 1<<31-1, func(c *Config) *int { return &c.tcpKeepalive }), nil),
+	live(intConfig("proto-max-bulk-len", "longest bulk string a client may send, in bytes", 1<<20, 1<<31-1, func(c *Config) *int { return &c.protoMaxBulk }), applyProtoMaxBulkLen),
+	live(boolConfig("protected-mode", "refuse clients not on the loopback interface while the default user has no password", func(c *Config) *bool { return &c.protectedMode }), nil),
+	live(enumConfig("loglevel", "log verbosity: debug, verbose, notice or warning", []string{"debug", "verbose", "notice", "warning"}, func(c *Config) *string { return &c.loglevel }), applyLoglevel),
+	stringConfig("logfile", "file to log to, empty for stdout", func(c *Config) *string { return &c.logfile }),
+	live(intConfig("slowlog-log-slower-than", "log commands slower than this many microseconds, -1 disables the slow log", -1, 1<<31-1, func(c *Config) *int { return &c.slowlogSlower }), applySlowlog),
+	live(intConfig("slowlog-max-len", "number of entries the slow log keeps", 0, 1<<31-1, func(c *Config) *int { return &c.slowlogMaxLen }), applySlowlog),
+	live(intConfig("latency-monitor-threshold", "sample events taking at least this many milliseconds, 0 disables the latency monitor", 0, 1<<31-1, func(c *Config) *int { return &c.latencyMonitor }), applyLatencyMonitor),
+	live(stringConfig("requirepass", "password clients must AUTH with, empty for none", func(c *Config) *string { return &c.requirepass }), applyRequirepass),
+	stringConfig("aclfile", "file with the ACL users, in ACL LIST format", func(c *Config) *string { return &c.aclfile }),
+	live(intConfig("acllog-max-len", "number of entries ACL LOG keeps", 0, 1<<31-1, func(c *Config) *int { return &c.acllogMaxLen }), applyACLLog),
+	stringConfig("audit-logfile", "file authentication events and administrative commands are appended to, empty to disable", func(c *Config) *string { return &c.auditLogfile }),
+	intConfig("metrics-port", "TCP port serving Prometheus metrics on /metrics, 0 to disable", 0, 65535, func(c *Config) *int { return &c.metricsPort }),
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		port:           6379,
+		shards:         16,
+		dir:            ".",
+		appendfilename: "append-only.aof",
+		appendfsync:    "everysec",
+		maxclients:     10000,
+		tcpKeepalive:   300,
+		protoMaxBulk:   512 << 20,
+		protectedMode:  true,
+		loglevel:       "notice",
+		slowlogSlower:  10000,
+		slowlogMaxLen:  128,
+		acllogMaxLen:   128,
+		tlsAuthClients: "no",
+		tlsMinVersion:  "tlsv1.2",
+	}
+}
+
+// live marks an option as settable at runtime
+func live(opt *configOption, apply func(s *Server) error) *configOption {
+	opt.mutable = true
+	opt.apply = apply
+	return opt
+}
+
+func applyAppendfsync(s *Server) error {
+	policy, err := parseFsyncPolicy(s.config.appendfsync)
+	if err != nil {
+		return err
+	}
+	s.aof.setFsyncPolicy(policy)
+	return nil
+}
+
+func applyLoglevel(s *Server) error {
+	return logger.setLevel(s.config.loglevel)
+}
+
+func applySlowlog(s *Server) error {
+	s.slowlog.configure(s.config.slowlogSlower, s.config.slowlogMaxLen)
+	return nil
+}
+
+func applyLatencyMonitor(s *Server) error {
+	s.latency.threshold.Store(int64(s.config.latencyMonitor))
+	return nil
+}
+
+func applyRequirepass(s *Server) error {
+	s.acl.setDefaultPassword(s.config.requirepass)
+	return nil
+}
+
+func applyProtoMaxBulkLen(s *Server) error {
+	s.protoMaxBulkLen.Store(int64(s.config.protoMaxBulk))
+	return nil
+}
+
+func applyACLLog(s *Server) error {
+	s.acllog.configure(s.config.acllogMaxLen)
+	return nil
+}
+
+func lookupConfigOption(name string) *configOption {
+	for _, opt := range configOptions {
+		if opt.name == name {
+			return opt
+		}
+	}
+	return nil
+}
+
+func stringConfig(name, usage string, field func(*Config) *string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			*field(c) = args[0]
+			return nil
+		},
+		get: func(c *Config) string { return *field(c) },
+	}
+}
+
+// listConfig takes any number of space separated values
+func listConfig(name, usage string, field func(*Config) *[]string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			var values []string
+			for _, arg := range args {
+				// a flag or CONFIG SET passes the whole list as one argument
+				values = append(values, strings.Fields(arg)...)
+			}
+			*field(c) = values
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(*field(c), " ") },
+	}
+}
+
+// octalConfig holds file permissions, written in octal like chmod
+func octalConfig(name, usage string, field func(*Config) *int) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			n, err := strconv.ParseUint(args[0], 8, 32)
+			if err != nil || n > 0o777 {
+				return errors.New("argument must be an octal permission between 0 and 777")
+			}
+			*field(c) = int(n)
+			return nil
+		},
+		get: func(c *Config) string { return strconv.FormatInt(int64(*field(c)), 8) },
+	}
+}
+
+func intConfig(name, usage string, min, max int, field func(*Config) *int) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*field(c) = n
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func boolConfig(name, usage string, field func(*Config) *bool) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			switch strings.ToLower(args[0]) {
+			case "yes":
+				*field(c) = true
+			case "no":
+				*field(c) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		get: func(c *Config) string {
+			if *field(c) {
+				return "yes"
+			}
+			return "no"
+		},
+	}
+}
+
+func enumConfig(name, usage string, values []string, field func(*Config) *string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("wrong number of arguments")
+			}
+			val := strings.ToLower(args[0])
+			if !slices.Contains(values, val) {
+				return fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(values, ", "))
+			}
+			*field(c) = val
+			return nil
+		},
+		get: func(c *Config) string { return *field(c) },
+	}
+}
+
+// parseConfig builds the configuration from the command line:
+//
+//	local-redis [/path/to/redis.conf] [--option value ...]
+//
+// Flags override directives from the config file.
+func parseConfig(args []string) (*Config, string, error) {
+	c := defaultConfig()
+	configFile := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		configFile = args[0]
+		args = args[1:]
+	}
+
+	// flags are applied after the file, so only remember them while parsing
+	type flagValue struct {
+		opt *configOption
+		val string
+	}
+	var flagValues []flagValue
+	fs := flag.NewFlagSet("local-redis", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: local-redis [/path/to/redis.conf] [--option value ...]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	for _, opt := range configOptions {
+		fs.Func(opt.name, opt.usage, func(val string) error {
+			flagValues = append(flagValues, flagValue{opt: opt, val: val})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+	if fs.NArg() > 0 {
+		return nil, "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if configFile != "" {
+		file, err := os.Open(configFile)
+		if err != nil {
+			return nil, "", err
+		}
+		defer file.Close()
+		if err := c.load(file, configFile); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, fv := range flagValues {
+		if err := fv.opt.set(c, []string{fv.val}); err != nil {
+			return nil, "", fmt.Errorf("invalid value for --%s %q: %w", fv.opt.name, fv.val, err)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, "", err
+	}
+	return c, configFile, nil
+}
+
+// load applies the directives of a redis.conf style file
+func (c *Config) load(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineNum, err)
+		}
+		opt := lookupConfigOption(strings.ToLower(args[0]))
+		if opt == nil {
+			return fmt.Errorf("%s:%d: bad directive %q", name, lineNum, args[0])
+		}
+		if err := opt.set(c, args[1:]); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", name, lineNum, opt.name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// validate checks settings that depend on the environment or each other
+func (c *Config) validate() error {
+	info, err := os.Stat(c.dir)
+	if err != nil {
+		return fmt.Errorf("dir %q: %w", c.dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("dir %q is not a directory", c.dir)
+	}
+	if c.appendfilename == "" || filepath.Base(c.appendfilename) != c.appendfilename {
+		return fmt.Errorf("appendfilename %q must be a plain file name", c.appendfilename)
+	}
+	if c.port == 0 && c.tlsPort == 0 && c.unixsocket == "" {
+		return errors.New("port, tls-port and unixsocket are all disabled, there's nothing to listen on")
+	}
+	return nil
+}
+
+// addresses returns the address to listen on for every bind address. The
+// optional flag is set for addresses with a leading -.
+func (c *Config) addresses(port int) (addrs []string, optional []bool) {
+	if len(c.bind) == 0 {
+		return []string{net.JoinHostPort("", strconv.Itoa(port))}, []bool{false}
+	}
+	for _, bind := range c.bind {
+		host, skippable := strings.CutPrefix(bind, "-")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		optional = append(optional, skippable)
+	}
+	return addrs, optional
+}
+
+// metricsAddress serves metrics on the first bind address
+func (c *Config) metricsAddress() string {
+	addrs, _ := c.addresses(c.metricsPort)
+	return addrs[0]
+}
+
+func (c *Config) aofPath() string {
+	return filepath.Join(c.dir, c.appendfilename)
+}
+
+// splitArgs splits a line into arguments like redis.conf does: arguments are
+// separated by whitespace and may be "double quoted" with C-style escapes
+// (\n, \t, \xff, ...) or 'single quoted' where only \' is an escape.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var current []byte
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 4
+					continue
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+					i++
+					continue
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				current = append(current, line[i])
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					current = append(current, '\'')
+					i += 2
+					continue
+				}
+				if line[i] == '\'' {
+					i++
+					break
+				}
+				current = append(current, line[i])
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				current = append(current, line[i])
+				i++
+			}
+			args = append(args, string(current))
+			continue
+		}
+		// a closing quote must be followed by a space or the end of the line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, errors.New("unbalanced quotes")
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t testing.TB, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	config, configFile, err := parseConfig(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if configFile != "" {
+		t.Errorf("Expected no config file, got %q", configFile)
+	}
+	if config.port != 6379 || config.shards != 16 || config.appendfilename != "append-only.aof" {
+		t.Errorf("Unexpected defaults: %+v", config)
+	}
+	if addrs, _ := config.addresses(config.port); len(addrs) != 1 || addrs[0] != ":6379" {
+		t.Errorf("Expected address ':6379', got %q", addrs)
+	}
+}
+
+func TestParseConfigFileAndFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfigFile(t, `
+# comments and blank lines are ignored
+port 7000
+bind 127.0.0.1
+shards 32
+dir "`+dir+`"
+appendfilename 'my aof.aof'
+appendfsync ALWAYS
+aof-sharded yes
+`)
+	config, configFile, err := parseConfig([]string{path, "--port", "7001", "--loglevel=warning"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if configFile != path {
+		t.Errorf("Expected config file %q, got %q", path, configFile)
+	}
+	if config.port != 7001 {
+		t.Errorf("Expected flag to override the file, got port %d", config.port)
+	}
+	if addrs, _ := config.addresses(config.port); len(addrs) != 1 || addrs[0] != "127.0.0.1:7001" {
+		t.Errorf("Expected address '127.0.0.1:7001', got %q", addrs)
+	}
+	if config.shards != 32 || !config.aofSharded || config.appendfsync != "always" || config.loglevel != "warning" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if config.aofPath() != filepath.Join(dir, "my aof.aof") {
+		t.Errorf("Unexpected AOF path %q", config.aofPath())
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		args     []string
+		expected string
+	}{
+		{"unknown directive", "porrt 7000\n", nil, "bad directive"},
+		{"bad integer", "port abc\n", nil, "couldn't be parsed into an integer"},
+		{"out of range", "shards 0\n", nil, "between 1 and"},
+		{"bad enum", "appendfsync sometimes\n", nil, "must be one of the following"},
+		{"bad bool", "aof-sharded maybe\n", nil, "'yes' or 'no'"},
+		{"unbalanced quotes", "dir \"/tmp\n", nil, "unbalanced quotes"},
+		{"missing dir", "dir /does/not/exist\n", nil, "/does/not/exist"},
+		{"bad flag", "", []string{"--port", "-1"}, "--port"},
+		{"unknown flag", "", []string{"--nope", "1"}, "nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{writeConfigFile(t, tt.contents)}, tt.args...)
+			_, _, err := parseConfig(args)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+	}{
+		{"set key value", []string{"set", "key", "value"}},
+		{"  spaced   out\t", []string{"spaced", "out"}},
+		{`"hello world" 'single quoted'`, []string{"hello world", "single quoted"}},
+		{`"esc\"aped\n" "\x41\x42"`, []string{"esc\"aped\n", "AB"}},
+		{`'it\'s'`, []string{"it's"}},
+		{`""`, []string{""}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		args, err := splitArgs(tt.line)
+		if err != nil {
+			t.Errorf("splitArgs(%q) returned error %v", tt.line, err)
+			continue
+		}
+		if strings.Join(args, "|") != strings.Join(tt.expected, "|") || len(args) != len(tt.expected) {
+			t.Errorf("splitArgs(%q) = %q, expected %q", tt.line, args, tt.expected)
+		}
+	}
+	for _, line := range []string{`"unterminated`, `'unterminated`, `"closed"trailing`} {
+		if _, err := splitArgs(line); err == nil {
+			t.Errorf("Expected splitArgs(%q) to fail", line)
+		}
+	}
+}
+
+func newTestServer(t testing.TB, configContents string) *Server {
+	t.Helper()
+	path := writeConfigFile(t, configContents)
+	config, configFile, err := parseConfig([]string{path, "--dir", t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	server, err := newServer(config, configFile)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.aof.Close() })
+	return server
+}
+
+func TestConfigGet(t *testing.T) {
+	server := newTestServer(t, "port 7000\n")
+	executor := server.newExecutor()
+
+	res := executor.handleCommand(command("CONFIG", "GET", "port"))
+	if len(res.array) != 2 || res.array[0].bulk != "port" || res.array[1].bulk != "7000" {
+		t.Errorf("Expected [port 7000], got %v", res.array)
+	}
+	res = executor.handleCommand(command("CONFIG", "GET", "append*", "MAXCLIENTS"))
+	names := []string{}
+	for i := 0; i < len(res.array); i += 2 {
+		names = append(names, res.array[i].bulk)
+	}
+	if strings.Join(names, ",") != "appendfilename,appendfsync,maxclients" {
+		t.Errorf("Unexpected CONFIG GET result %v", names)
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	server := newTestServer(t, "")
+	executor := server.newExecutor()
+
+	res := executor.handleCommand(command("CONFIG", "SET", "appendfsync", "always", "maxclients", "50"))
+	if res.typ != "string" || res.str != "OK" {
+		t.Fatalf("Expected OK, got %v", res)
+	}
+	if fsyncPolicy(server.aof.fsync.Load()) != fsyncAlways {
+		t.Error("Expected the AOF to pick up the new fsync policy")
+	}
+	if server.config.maxclients != 50 {
+		t.Errorf("Expected maxclients 50, got %d", server.config.maxclients)
+	}
+
+	res = executor.handleCommand(command("CONFIG", "SET", "port", "7000"))
+	if res.typ != "error" || !strings.Contains(res.str, "immutable") {
+		t.Errorf("Expected immutable config error, got %v", res)
+	}
+	res = executor.handleCommand(command("CONFIG", "SET", "nope", "1"))
+	if res.typ != "error" || !strings.Contains(res.str, "Unknown option") {
+		t.Errorf("Expected unknown option error, got %v", res)
+	}
+
+	// an invalid value leaves every option of the command untouched
+	res = executor.handleCommand(command("CONFIG", "SET", "maxclients", "60", "appendfsync", "sometimes"))
+	if res.typ != "error" || !strings.Contains(res.str, "appendfsync") {
+		t.Errorf("Expected appendfsync error, got %v", res)
+	}
+	if server.config.maxclients != 50 || server.config.appendfsync != "always" {
+		t.Errorf("Expected a failed CONFIG SET to roll back, got maxclients=%d appendfsync=%s", server.config.maxclients, server.config.appendfsync)
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	server := newTestServer(t, "# keep this comment\nappendfsync no\n\n# and this one\nloglevel notice\nloglevel debug\n")
+	executor := server.newExecutor()
+
+	executor.handleCommand(command("CONFIG", "SET", "appendfsync", "always", "maxclients", "123"))
+	res := executor.handleCommand(command("CONFIG", "REWRITE"))
+	if res.typ != "string" || res.str != "OK" {
+		t.Fatalf("Expected OK, got %v", res)
+	}
+	contents, err := os.ReadFile(server.configFile)
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+	// dir was given as a flag, so it's appended along with maxclients
+	expected := "# keep this comment\nappendfsync always\n\n# and this one\nloglevel debug\n" +
+		configRewriteSignature + "\n" + formatConfigLine(lookupConfigOption("dir"), server.config) + "\nmaxclients 123\n"
+	if string(contents) != expected {
+		t.Errorf("Expected config file:\n%s\ngot:\n%s", expected, contents)
+	}
+
+	// the rewritten file parses back to the same settings
+	config, _, err := parseConfig([]string{server.configFile})
+	if err != nil {
+		t.Fatalf("Failed to parse rewritten config: %v", err)
+	}
+	if config.appendfsync != "always" || config.maxclients != 123 || config.loglevel != "debug" {
+		t.Errorf("Unexpected config after rewrite: %+v", config)
+	}
+}
+
+func TestQuoteConfigArg(t *testing.T) {
+	for _, arg := range []string{"plain", "", "with space", `quo"te`, "new\nline", "\x01bin", `back\slash`} {
+		args, err := splitArgs("name " + quoteConfigArg(arg))
+		if err != nil || len(args) != 2 || args[1] != arg {
+			t.Errorf("Expected %q to round trip, got %q (%v)", arg, args, err)
+		}
+	}
+}
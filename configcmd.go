@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func (e *Executor) handleConfigCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config' command"}
+	}
+	if e.server == nil {
+		return Value{typ: "error", str: "ERR CONFIG is not available"}
+	}
+	subcommand := strings.ToUpper(array[0].bulk)
+	args := array[1:]
+	switch subcommand {
+	case "GET":
+		if len(args) < 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|get' command"}
+		}
+		return e.server.configGet(args)
+	case "SET":
+		if len(args) < 2 || len(args)%2 == 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|set' command"}
+		}
+		return e.server.configSet(args)
+	case "RESETSTAT":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|resetstat' command"}
+		}
+		e.server.resetStats()
+		return Value{typ: "string", str: "OK"}
+	case "REWRITE":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|rewrite' command"}
+		}
+		if err := e.server.rewriteConfig(); err != nil {
+			return Value{typ: "error", str: "ERR Rewriting config file: " + err.Error()}
+		}
+		logNoticef("CONFIG REWRITE executed with success.")
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", array[0].bulk)}
+	}
+}
+
+// configGet returns name/value pairs for every option matching a glob pattern
+func (s *Server) configGet(patterns []Value) Value {
+	s.config.lock.RLock()
+	defer s.config.lock.RUnlock()
+	res := Value{typ: "map", array: []Value{}}
+	for _, opt := range configOptions {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.ToLower(pattern.bulk), opt.name); matched {
+				res.array = append(res.array, Value{typ: "bulk", bulk: opt.name}, Value{typ: "bulk", bulk: opt.get(s.config)})
+				break
+			}
+		}
+	}
+	return res
+}
+
+// configSet applies every name/value pair or none of them
+func (s *Server) configSet(args []Value) Value {
+	opts := make([]*configOption, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(args[i].bulk)
+		opt := lookupConfigOption(name)
+		if opt == nil {
+			return Value{typ: "error", str: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i].bulk)}
+		}
+		if !opt.mutable {
+			return configSetError(name, "can't set immutable config")
+		}
+		for _, seen := range opts {
+			if seen == opt {
+				return configSetError(name, "duplicate parameter")
+			}
+		}
+		opts = append(opts, opt)
+	}
+
+	s.config.lock.Lock()
+	defer s.config.lock.Unlock()
+	previous := make([]string, len(opts))
+	for i, opt := range opts {
+		previous[i] = opt.get(s.config)
+	}
+	// restore puts back the values from before the command, and pushes them
+	// to the components that were already updated
+	restore := func(upTo int) {
+		for i := 0; i < upTo; i++ {
+			opts[i].set(s.config, []string{previous[i]})
+			if opts[i].apply != nil {
+				opts[i].apply(s)
+			}
+		}
+	}
+	for i, opt := range opts {
+		if err := opt.set(s.config, []string{args[i*2+1].bulk}); err != nil {
+			restore(i)
+			return configSetError(opt.name, err.Error())
+		}
+	}
+	for _, opt := range opts {
+		if opt.apply == nil {
+			continue
+		}
+		if err := opt.apply(s); err != nil {
+			restore(len(opts))
+			return configSetError(opt.name, err.Error())
+		}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+func configSetError(name string, reason string) Value {
+	return Value{typ: "error", str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, reason)}
+}
+
+// marks directives appended by CONFIG REWRITE
+const configRewriteSignature = "# Generated by CONFIG REWRITE"
+
+// rewriteConfig writes the current settings back to the config file. Lines
+// for known directives are updated in place, so comments and ordering are
+// kept; options that differ from their default and aren't in the file yet
+// are appended at the end.
+func (s *Server) rewriteConfig() error {
+	if s.configFile == "" {
+		return errors.New("the server is running without a config file")
+	}
+	s.config.lock.RLock()
+	defer s.config.lock.RUnlock()
+
+	var lines []string
+	file, err := os.Open(s.configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	rewritten := make([]string, 0, len(lines))
+	written := make(map[*configOption]bool)
+	hasSignature := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == configRewriteSignature {
+			hasSignature = true
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		args, err := splitArgs(trimmed)
+		var opt *configOption
+		if err == nil {
+			opt = lookupConfigOption(strings.ToLower(args[0]))
+		}
+		if opt == nil {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		// only the first occurrence of a directive survives
+		if written[opt] {
+			continue
+		}
+		written[opt] = true
+		rewritten = append(rewritten, formatConfigLine(opt, s.config))
+	}
+
+	defaults := defaultConfig()
+	for _, opt := range configOptions {
+		if written[opt] || opt.get(s.config) == opt.get(defaults) {
+			continue
+		}
+		if !hasSignature {
+			rewritten = append(rewritten, configRewriteSignature)
+			hasSignature = true
+		}
+		rewritten = append(rewritten, formatConfigLine(opt, s.config))
+	}
+
+	// write to a temporary file first so a crash never leaves a half-written config
+	tmp, err := os.CreateTemp(filepath.Dir(s.configFile), ".redis.conf-rewrite-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(rewritten, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.configFile); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	return os.Rename(tmp.Name(), s.configFile)
+}
+
+func formatConfigLine(opt *configOption, c *Config) string {
+	return opt.name + " " + quoteConfigArg(opt.get(c))
+}
+
+// quoteConfigArg quotes a value so splitArgs reads it back unchanged
+func quoteConfigArg(arg string) string {
+	needsQuotes := arg == ""
+	for i := 0; i < len(arg) && !needsQuotes; i++ {
+		c := arg[i]
+		needsQuotes = isSpace(c) || c == '"' || c == '\'' || c == '\\' || c < 32 || c > 126
+	}
+	if !needsQuotes {
+		return arg
+	}
+	return reprString(arg)
+}
+
+// reprString double quotes s with C-style escapes, the format splitArgs
+// parses and MONITOR prints
+func reprString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || c == '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c == '\r':
+			sb.WriteString(`\r`)
+		case c == '\t':
+			sb.WriteString(`\t`)
+		case c == '\a':
+			sb.WriteString(`\a`)
+		case c == '\b':
+			sb.WriteString(`\b`)
+		case c < 32 || c > 126:
+			fmt.Fprintf(&sb, `\x%02x`, c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const protectedModeError = "DENIED Running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. To accept clients from other hosts either " +
+	"1) disable protected mode with 'CONFIG SET protected-mode no' from the loopback interface, making sure the server isn't reachable from the internet, " +
+	"2) set 'protected-mode no' in the configuration file and restart the server, " +
+	"3) start the server with '--protected-mode no', or " +
+	"4) set a password for the default user with requirepass or ACL SETUSER."
+
+// admit decides whether a new connection may be served, returning the error
+// it's refused with otherwise. The connection must already be counted in
+// connectedClients.
+func (s *Server) admit(conn net.Conn) string {
+	s.config.lock.RLock()
+	maxclients, protected := s.config.maxclients, s.config.protectedMode
+	s.config.lock.RUnlock()
+	if s.stats.connectedClients.Load() > int64(maxclients) {
+		s.stats.rejectedConnections.Add(1)
+		return "ERR max number of clients reached"
+	}
+	if protected && !isLoopback(conn.RemoteAddr()) {
+		if u := s.acl.user("default"); u != nil && u.nopass {
+			return protectedModeError
+		}
+	}
+	return ""
+}
+
+// isLoopback reports whether a client connected from the same host. Unix
+// socket clients always are.
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return !ok || tcp.IP.IsLoopback()
+}
+
+// setKeepAlive applies tcp-keepalive to a TCP or TLS connection: probes
+// start after the connection was idle for that many seconds and it's closed
+// after 3 unanswered ones.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	s.config.lock.RLock()
+	interval := time.Duration(s.config.tcpKeepalive) * time.Second
+	s.config.lock.RUnlock()
+	if interval == 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     interval,
+		Interval: max(interval/3, time.Second),
+		Count:    3,
+	})
+}
+
+// closeIdleClients closes clients that sent nothing for longer than
+// timeout. Monitors and commands held by CLIENT PAUSE aren't idle.
+func (s *Server) closeIdleClients() {
+	s.config.lock.RLock()
+	timeout := time.Duration(s.config.timeout) * time.Second
+	s.config.lock.RUnlock()
+	if timeout == 0 {
+		return
+	}
+	for _, c := range s.clients.list() {
+		c.lock.Lock()
+		idle := time.Since(c.lastInteraction) > timeout && !c.monitor
+		c.lock.Unlock()
+		if idle && !c.blocked.Load() {
+			logVerbosef("Closing idle client %s", c.addr)
+			c.close()
+		}
+	}
+}
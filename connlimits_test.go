@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxClients(t *testing.T) {
+	server := newTestServer(t, "maxclients 1\n")
+	c := dialTestServer(t, server)
+	if res := c.do(t, "PING"); res.str != "PONG" {
+		t.Fatalf("Expected PONG, got %v", res)
+	}
+
+	rejected := dialTestServer(t, server)
+	rejected.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if res, err := rejected.parser.readResp(); err != nil || res.str != "ERR max number of clients reached" {
+		t.Errorf("Expected the max clients error, got %v (%v)", res, err)
+	}
+	if _, err := rejected.parser.readResp(); err == nil {
+		t.Errorf("Expected the rejected connection to be closed")
+	}
+	if info := c.do(t, "INFO", "stats").bulk; !strings.Contains(info, "rejected_connections:1\r\n") {
+		t.Errorf("Expected one rejected connection, got %q", info)
+	}
+}
+
+// remoteConn pretends to be connected from addr
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestProtectedMode(t *testing.T) {
+	server := newTestServer(t, "")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	remote := remoteConn{Conn: conn, addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}}
+	local := remoteConn{Conn: conn, addr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5000}}
+
+	if reason := server.admit(remote); !strings.HasPrefix(reason, "DENIED") {
+		t.Errorf("Expected remote clients to be denied without a password, got %q", reason)
+	}
+	if reason := server.admit(local); reason != "" {
+		t.Errorf("Expected loopback clients to be admitted, got %q", reason)
+	}
+	server.acl.setDefaultPassword("s3cret")
+	if reason := server.admit(remote); reason != "" {
+		t.Errorf("Expected remote clients to be admitted with a password, got %q", reason)
+	}
+	server.acl.setDefaultPassword("")
+	server.newExecutor().handleCommand(command("CONFIG", "SET", "protected-mode", "no"))
+	if reason := server.admit(remote); reason != "" {
+		t.Errorf("Expected remote clients to be admitted without protected mode, got %q", reason)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := newTestServer(t, "timeout 1\n")
+	idle := dialTestServer(t, server)
+	idle.do(t, "PING")
+	monitor := dialTestServer(t, server)
+	monitor.do(t, "MONITOR")
+	active := dialTestServer(t, server)
+	active.do(t, "PING")
+	for server.monitors.count.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clients := server.clients.list()
+	for _, c := range clients[:2] {
+		c.lock.Lock()
+		c.lastInteraction = time.Now().Add(-time.Minute)
+		c.lock.Unlock()
+	}
+	server.closeIdleClients()
+
+	idle.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.parser.readResp(); err == nil {
+		t.Errorf("Expected the idle client to be closed")
+	}
+	if res := active.do(t, "PING"); res.str != "PONG" {
+		t.Errorf("Expected the active client to stay connected, got %v", res)
+	}
+	// the monitor sees the PING, so it wasn't closed
+	monitor.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := monitor.parser.readResp(); err != nil || !strings.Contains(line.str, `"PING"`) {
+		t.Errorf("Expected the monitor to stay connected, got %v (%v)", line, err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (e *Executor) handleDebugCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug' command"}
+	}
+	switch strings.ToUpper(array[0].bulk) {
+	case "SHARDSTATS":
+		// per shard lock acquisitions, wait and hold times, to size the shard count
+		if len(array) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|shardstats' command"}
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "shards:%d\r\n", e.db.shardCount)
+		e.db.writeShardStats(&sb)
+		return Value{typ: "bulk", bulk: sb.String()}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try DEBUG HELP.", array[0].bulk)}
+	}
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Executor struct {
 	db  *KV
 	aof *AOF
+	// shared server state, nil for executors replaying the AOF
+	server *Server
+	// connection the commands come from, nil for internal executors
+	client *Client
 }
 
 type KeyValuePair struct {
@@ -24,7 +29,79 @@ func (e *Executor) handleCommand(input Value) Value {
 	if input.typ != "array" {
 		return Value{typ: "error", str: "ERR expected array type"}
 	}
-	switch strings.ToUpper(input.array[0].bulk) {
+	if len(input.array) == 0 {
+		return Value{typ: "error", str: "ERR empty command"}
+	}
+	command := strings.ToUpper(input.array[0].bulk)
+	spec := lookupCommand(command)
+	if e.client != nil {
+		e.client.recordCommand(spec, input)
+	}
+	if res := e.checkAuth(spec); res.typ == "error" {
+		e.recordRejected(spec, res)
+		return res
+	}
+	if res := e.checkACL(spec, input); res.typ == "error" {
+		e.recordRejected(spec, res)
+		return res
+	}
+	// commands held by CLIENT PAUSE wait here, after the auth and ACL checks
+	// but before checkCommand, so they see the state the server is in (e.g.
+	// LOADING or MISCONF) once they resume
+	if e.server != nil && e.client != nil {
+		held, dropped := e.server.pause.wait(e.client, spec, input)
+		if dropped {
+			// the client was killed or hung up while the command was held
+			return Value{typ: "quit"}
+		}
+		if held {
+			defer e.server.pause.releaseNext()
+		}
+	}
+	if res := e.checkCommand(spec); res.typ == "error" {
+		e.recordRejected(spec, res)
+		return res
+	}
+	if e.server == nil {
+		return e.execute(command, input)
+	}
+	start := time.Now()
+	res := e.execute(command, input)
+	duration := time.Since(start)
+	e.server.stats.recordCall(spec, duration, res)
+	logged := spec.loggable(input)
+	e.server.slowlog.record(logged, duration, e.client)
+	e.server.latency.add("command", duration)
+	if spec != nil {
+		e.server.monitors.feed(e.client, logged)
+	}
+	e.server.audit.command(e.client, spec, input, res)
+	return res
+}
+
+// checkCommand returns an error if the command can't run right now
+func (e *Executor) checkCommand(spec *commandSpec) Value {
+	if e.aof != nil && e.aof.loading.active.Load() && !spec.allowedWhileLoading() {
+		return Value{typ: "error", str: "LOADING Redis is loading the dataset in memory"}
+	}
+	// keep serving reads but refuse writes that can't be persisted
+	if e.aof != nil && spec.isWrite() {
+		if err := e.aof.writeError(); err != nil {
+			return misconfError(err)
+		}
+	}
+	return Value{}
+}
+
+func (e *Executor) recordRejected(spec *commandSpec, res Value) {
+	if e.server != nil {
+		e.server.stats.recordRejected(spec, res)
+	}
+}
+
+// execute dispatches an upper-cased command name to its handler
+func (e *Executor) execute(command string, input Value) Value {
+	switch command {
 	case "PING":
 		return e.handlePingCommand(input.array[1:])
 	case "INCR":
@@ -81,10 +158,34 @@ func (e *Executor) handleCommand(input Value) Value {
 			e.persistToAOF(input)
 		}
 		return res
+	case "INFO":
+		return e.handleInfoCommand(input.array[1:])
+	case "CONFIG":
+		return e.handleConfigCommand(input.array[1:])
+	case "SLOWLOG":
+		return e.handleSlowlogCommand(input.array[1:])
+	case "LATENCY":
+		return e.handleLatencyCommand(input.array[1:])
+	case "AUTH":
+		return e.handleAuthCommand(input.array[1:])
+	case "HELLO":
+		return e.handleHelloCommand(input.array[1:])
+	case "CLIENT":
+		return e.handleClientCommand(input.array[1:])
+	case "ACL":
+		return e.handleACLCommand(input.array[1:])
+	case "DEBUG":
+		return e.handleDebugCommand(input.array[1:])
 	case "COMMAND":
 		// redis-cli asks for "COMMAND DOCS" or just "COMMAND" on startup for smart auto-completion
 		// we'll stub this implementation for now by returning an empty array
 		return Value{typ: "array", array: []Value{}}
+	case "MONITOR":
+		if e.server == nil {
+			return Value{typ: "error", str: "ERR MONITOR is not available"}
+		}
+		// handleConnection switches the connection to monitor mode
+		return Value{typ: "monitor"}
 	case "QUIT":
 		return Value{typ: "quit"}
 	default:
@@ -144,7 +245,12 @@ func (e *Executor) handleKeysCommand(array []Value) Value {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'keys' command"}
 	}
 	pattern := array[0].bulk
-	return e.db.keys(pattern)
+	start := time.Now()
+	res := e.db.keys(pattern)
+	if e.server != nil {
+		e.server.latency.add("keys-scan", time.Since(start))
+	}
+	return res
 }
 
 func (e *Executor) handleRenameCommand(array []Value) Value {
@@ -0,0 +1,86 @@
+package main
+
+// globMatch reports whether s matches a glob-style pattern the way Redis
+// matches key patterns: '*' matches any run of bytes, '/' included, '?' any
+// single byte, [abc], [^abc] and [a-z] a byte from a class, and '\' escapes
+// the next byte. Unlike path.Match a malformed pattern isn't an error, an
+// unterminated class simply runs to the end of the pattern.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// position after the last '*' seen and where its match started, so a
+	// mismatch can retry with the star swallowing one more byte
+	star, starMatch := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				p++
+				star, starMatch = p, i
+				continue
+			}
+			if matched, width := globMatchByte(pattern[p:], s[i]); matched {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starMatch++
+		p, i = star, starMatch
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchByte matches c against the token at the start of pattern, which
+// isn't a '*', and returns how many pattern bytes the token took
+func globMatchByte(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '\\':
+		if len(pattern) > 1 {
+			return pattern[1] == c, 2
+		}
+		return c == '\\', 1
+	case '[':
+		return globMatchClass(pattern, c)
+	default:
+		return pattern[0] == c, 1
+	}
+}
+
+// globMatchClass matches c against the class at the start of pattern
+func globMatchClass(pattern string, c byte) (bool, int) {
+	p := 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			matched = matched || pattern[p+1] == c
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			p += 3
+		default:
+			matched = matched || pattern[p] == c
+			p++
+		}
+	}
+	if p < len(pattern) {
+		// the closing ']'
+		p++
+	}
+	return matched != negate, p
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// handleHelloCommand implements HELLO [protover [AUTH username password]
+// [SETNAME clientname]], which switches the connection between RESP2 and
+// RESP3 and replies with a map describing the server
+func (e *Executor) handleHelloCommand(array []Value) Value {
+	if e.server == nil || e.client == nil {
+		return Value{typ: "error", str: "ERR HELLO is not available"}
+	}
+	c := e.client
+	c.lock.Lock()
+	protocol := c.protocol
+	c.lock.Unlock()
+	if len(array) > 0 {
+		n, err := strconv.Atoi(array[0].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if n != 2 && n != 3 {
+			return Value{typ: "error", str: "NOPROTO unsupported protocol version"}
+		}
+		protocol = n
+	}
+
+	var username, password, name string
+	auth, setName := false, false
+	for i := 1; i < len(array); i++ {
+		option := strings.ToUpper(array[i].bulk)
+		switch {
+		case option == "AUTH" && i+2 < len(array):
+			auth, username, password = true, array[i+1].bulk, array[i+2].bulk
+			i += 2
+		case option == "SETNAME" && i+1 < len(array):
+			setName, name = true, array[i+1].bulk
+			i++
+		default:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", array[i].bulk)}
+		}
+	}
+	if setName && !validClientName(name) {
+		return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+	}
+	if auth {
+		if res := e.authenticate(username, password); res.typ == "error" {
+			return res
+		}
+	} else if !c.authenticated {
+		return Value{typ: "error", str: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	c.lock.Lock()
+	c.protocol = protocol
+	if setName {
+		c.name = name
+	}
+	c.lock.Unlock()
+
+	bulk := func(s string) Value { return Value{typ: "bulk", bulk: s} }
+	return Value{typ: "map", array: []Value{
+		bulk("server"), bulk("redis"),
+		bulk("version"), bulk(redisVersion),
+		bulk("proto"), {typ: "integer", num: protocol},
+		bulk("id"), {typ: "integer", num: int(c.id)},
+		bulk("mode"), bulk("standalone"),
+		bulk("role"), bulk("master"),
+		bulk("modules"), {typ: "array", array: []Value{}},
+	}}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	server := newTestServer(t, "requirepass s3cret\n")
+	c := dialTestServer(t, server)
+
+	if res := c.do(t, "HELLO", "3"); res.typ != "error" || !strings.HasPrefix(res.str, "NOAUTH") {
+		t.Errorf("Expected HELLO without AUTH to be refused, got %v", res)
+	}
+	if res := c.do(t, "HELLO", "4"); res.typ != "error" || !strings.HasPrefix(res.str, "NOPROTO") {
+		t.Errorf("Expected NOPROTO, got %v", res)
+	}
+	if res := c.do(t, "HELLO", "3", "AUTH", "default", "wrong"); res.typ != "error" || !strings.HasPrefix(res.str, "WRONGPASS") {
+		t.Errorf("Expected WRONGPASS, got %v", res)
+	}
+
+	res := c.do(t, "HELLO", "3", "AUTH", "default", "s3cret", "SETNAME", "worker")
+	if res.typ != "map" {
+		t.Fatalf("Expected a RESP3 map, got %v", res)
+	}
+	fields := map[string]Value{}
+	for i := 0; i+1 < len(res.array); i += 2 {
+		fields[res.array[i].bulk] = res.array[i+1]
+	}
+	if fields["proto"].num != 3 || fields["server"].bulk != "redis" || fields["role"].bulk != "master" {
+		t.Errorf("Unexpected HELLO reply %v", res)
+	}
+
+	// replies now use the RESP3 types
+	if res := c.do(t, "GET", "missing"); res.typ != "null" {
+		t.Errorf("Expected a null, got %v", res)
+	}
+	if res := c.do(t, "CONFIG", "GET", "maxclients"); res.typ != "map" {
+		t.Errorf("Expected CONFIG GET to reply with a map, got %v", res)
+	}
+	info := c.do(t, "CLIENT", "INFO")
+	if info.typ != "verbatim" || !strings.Contains(info.bulk, " name=worker ") || !strings.Contains(info.bulk, " resp=3 ") {
+		t.Errorf("Expected a verbatim CLIENT INFO for worker with resp=3, got %v", info)
+	}
+
+	if res := c.do(t, "HELLO", "2"); res.typ != "array" {
+		t.Errorf("Expected HELLO 2 to reply with a flat array, got %v", res)
+	}
+	if res := c.do(t, "CONFIG", "GET", "maxclients"); res.typ != "array" {
+		t.Errorf("Expected RESP2 replies after HELLO 2, got %v", res)
+	}
+}
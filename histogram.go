@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// number of power-of-two microsecond buckets, 1us up to ~16.7s. Slower
+// observations land in one extra overflow bucket.
+const histogramBuckets = 25
+
+// latencyHistogram counts durations in power-of-two microsecond buckets.
+// It's safe for concurrent use without a lock.
+type latencyHistogram struct {
+	buckets [histogramBuckets + 1]atomic.Int64
+	count   atomic.Int64
+	// total of all observations in nanoseconds
+	sum atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.buckets[histogramBucket(d)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// histogramBucket returns the smallest bucket i with d <= 2^i us
+func histogramBucket(d time.Duration) int {
+	us := d.Microseconds()
+	if us <= 1 {
+		return 0
+	}
+	return min(bits.Len64(uint64(us-1)), histogramBuckets)
+}
+
+// histogramBound is the inclusive upper bound of bucket i
+func histogramBound(i int) time.Duration {
+	return time.Duration(1<<i) * time.Microsecond
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.buckets {
+		h.buckets[i].Store(0)
+	}
+	h.count.Store(0)
+	h.sum.Store(0)
+}
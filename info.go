@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// infoSection is a section of the INFO reply. write is only called with a
+// server unless the section says it works without one.
+type infoSection struct {
+	name string
+	// included by INFO without arguments and INFO default
+	inDefault bool
+	// the section can be written by executors without a server
+	noServer bool
+	write    func(e *Executor, sb *strings.Builder)
+}
+
+var infoSections = []infoSection{
+	{name: "server", inDefault: true, write: writeServerInfo},
+	{name: "clients", inDefault: true, write: writeClientsInfo},
+	{name: "memory", inDefault: true, noServer: true, write: writeMemoryInfo},
+	{name: "persistence", inDefault: true, noServer: true, write: writePersistenceInfo},
+	{name: "stats", inDefault: true, write: writeStatsInfo},
+	{name: "replication", inDefault: true, write: writeReplicationInfo},
+	{name: "commandstats", write: func(e *Executor, sb *strings.Builder) { e.server.stats.writeCommandStats(sb) }},
+	{name: "errorstats", inDefault: true, write: func(e *Executor, sb *strings.Builder) { e.server.stats.writeErrorStats(sb) }},
+	{name: "keyspace", inDefault: true, noServer: true, write: writeKeyspaceInfo},
+	{name: "shardstats", noServer: true, write: func(e *Executor, sb *strings.Builder) { e.db.writeShardStats(sb) }},
+}
+
+func (e *Executor) handleInfoCommand(array []Value) Value {
+	selected := make(map[string]bool)
+	all := false
+	if len(array) == 0 {
+		selected["default"] = true
+	}
+	for _, arg := range array {
+		name := strings.ToLower(arg.bulk)
+		if name == "all" || name == "everything" {
+			all = true
+		}
+		selected[name] = true
+	}
+
+	var sb strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[section.name] && !(selected["default"] && section.inDefault) {
+			continue
+		}
+		if e.server == nil && !section.noServer {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		fmt.Fprintf(&sb, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.write(e, &sb)
+	}
+	return Value{typ: "verbatim", str: "txt", bulk: sb.String()}
+}
+
+// the Redis version reported to clients, the one whose behaviour is followed
+const redisVersion = "7.2.0"
+
+func writeServerInfo(e *Executor, sb *strings.Builder) {
+	s := e.server
+	uptime := time.Since(s.startTime)
+	executable, _ := os.Executable()
+	s.config.lock.RLock()
+	port, shards := s.config.port, s.config.shards
+	s.config.lock.RUnlock()
+	fmt.Fprintf(sb, "redis_version:%s\r\n", redisVersion)
+	sb.WriteString("redis_mode:standalone\r\n")
+	fmt.Fprintf(sb, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(sb, "arch_bits:%d\r\n", strconv.IntSize)
+	fmt.Fprintf(sb, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(sb, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(sb, "run_id:%s\r\n", s.runID)
+	fmt.Fprintf(sb, "tcp_port:%d\r\n", port)
+	fmt.Fprintf(sb, "server_time_usec:%d\r\n", time.Now().UnixMicro())
+	fmt.Fprintf(sb, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	fmt.Fprintf(sb, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+	fmt.Fprintf(sb, "shards:%d\r\n", shards)
+	fmt.Fprintf(sb, "executable:%s\r\n", executable)
+	fmt.Fprintf(sb, "config_file:%s\r\n", s.configFile)
+}
+
+func writeClientsInfo(e *Executor, sb *strings.Builder) {
+	e.server.config.lock.RLock()
+	maxclients := e.server.config.maxclients
+	e.server.config.lock.RUnlock()
+	fmt.Fprintf(sb, "connected_clients:%d\r\n", e.server.stats.connectedClients.Load())
+	fmt.Fprintf(sb, "maxclients:%d\r\n", maxclients)
+	blocked := 0
+	for _, c := range e.server.clients.list() {
+		if c.blocked.Load() {
+			blocked++
+		}
+	}
+	fmt.Fprintf(sb, "blocked_clients:%d\r\n", blocked)
+	fmt.Fprintf(sb, "pause_mode:%s\r\n", e.server.pause.modeName())
+}
+
+func writeMemoryInfo(e *Executor, sb *strings.Builder) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(sb, "used_memory:%d\r\n", mem.HeapAlloc)
+	fmt.Fprintf(sb, "used_memory_human:%s\r\n", humanBytes(mem.HeapAlloc))
+	// the process and system figures come from /proc and are left out where
+	// it isn't available
+	if rss, ok := processRSS(); ok {
+		fmt.Fprintf(sb, "used_memory_rss:%d\r\n", rss)
+		fmt.Fprintf(sb, "used_memory_rss_human:%s\r\n", humanBytes(rss))
+	}
+	fmt.Fprintf(sb, "used_memory_heap_inuse:%d\r\n", mem.HeapInuse)
+	fmt.Fprintf(sb, "used_memory_stack:%d\r\n", mem.StackInuse)
+	fmt.Fprintf(sb, "used_memory_go_sys:%d\r\n", mem.Sys)
+	if total, ok := totalSystemMemory(); ok {
+		fmt.Fprintf(sb, "total_system_memory:%d\r\n", total)
+		fmt.Fprintf(sb, "total_system_memory_human:%s\r\n", humanBytes(total))
+	}
+	sb.WriteString("mem_allocator:go\r\n")
+	fmt.Fprintf(sb, "gc_cycles:%d\r\n", mem.NumGC)
+	fmt.Fprintf(sb, "gc_pause_total_ns:%d\r\n", mem.PauseTotalNs)
+}
+
+// processRSS returns the resident set size, the second field of
+// /proc/self/statm in pages
+func processRSS() (uint64, bool) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(os.Getpagesize()), true
+}
+
+// totalSystemMemory returns MemTotal from /proc/meminfo
+func totalSystemMemory() (uint64, bool) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "MemTotal:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb * 1024, true
+	}
+	return 0, false
+}
+
+// humanBytes formats a byte count like Redis does, e.g. 1.50M
+func humanBytes(n uint64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	val := float64(n) / 1024
+	unit := 0
+	for val >= 1024 && unit < len(units)-1 {
+		val /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%c", val, units[unit])
+}
+
+func writePersistenceInfo(e *Executor, sb *strings.Builder) {
+	if e.aof == nil {
+		sb.WriteString("loading:0\r\n")
+		sb.WriteString("aof_enabled:0\r\n")
+		return
+	}
+	e.aof.loading.writeInfo(sb)
+	e.aof.writeInfo(sb)
+}
+
+func writeStatsInfo(e *Executor, sb *strings.Builder) {
+	st := e.server.stats
+	fmt.Fprintf(sb, "total_connections_received:%d\r\n", st.connectionsReceived.Load())
+	fmt.Fprintf(sb, "total_commands_processed:%d\r\n", st.commandsProcessed.Load())
+	fmt.Fprintf(sb, "rejected_connections:%d\r\n", st.rejectedConnections.Load())
+	fmt.Fprintf(sb, "instantaneous_ops_per_sec:%d\r\n", st.instantaneousOps())
+	fmt.Fprintf(sb, "total_net_input_bytes:%d\r\n", st.netInputBytes.Load())
+	fmt.Fprintf(sb, "total_net_output_bytes:%d\r\n", st.netOutputBytes.Load())
+	fmt.Fprintf(sb, "keyspace_hits:%d\r\n", e.db.hits.Load())
+	fmt.Fprintf(sb, "keyspace_misses:%d\r\n", e.db.misses.Load())
+	fmt.Fprintf(sb, "acl_access_denied_auth:%d\r\n", st.aclDeniedAuth.Load())
+	fmt.Fprintf(sb, "acl_access_denied_cmd:%d\r\n", st.aclDeniedCmd.Load())
+	fmt.Fprintf(sb, "acl_access_denied_key:%d\r\n", st.aclDeniedKey.Load())
+}
+
+func writeReplicationInfo(e *Executor, sb *strings.Builder) {
+	sb.WriteString("role:master\r\n")
+	sb.WriteString("connected_slaves:0\r\n")
+}
+
+func writeKeyspaceInfo(e *Executor, sb *strings.Builder) {
+	// there's a single database, and keys never expire
+	if keys := e.db.size(); keys > 0 {
+		fmt.Fprintf(sb, "db0:keys=%d,expires=0,avg_ttl=0\r\n", keys)
+	}
+}
+
+// writeInfo appends the AOF fields of the persistence section
+func (aof *AOF) writeInfo(sb *strings.Builder) {
+	var size int64
+	pending := 0
+	var writeErr error
+	var writeErrTime time.Time
+	for _, f := range aof.files {
+		f.lock.RLock()
+		size += f.size
+		pending += len(f.pending)
+		if f.writeErr != nil && writeErr == nil {
+			writeErr, writeErrTime = f.writeErr, f.writeErrTime
+		}
+		f.lock.RUnlock()
+	}
+
+	sb.WriteString("aof_enabled:1\r\n")
+	if aof.files[0].cipher != nil {
+		sb.WriteString("aof_encrypted:1\r\n")
+	} else {
+		sb.WriteString("aof_encrypted:0\r\n")
+	}
+	if aof.kv != nil {
+		fmt.Fprintf(sb, "aof_sharded:1\r\naof_segments:%d\r\n", len(aof.files))
+	} else {
+		sb.WriteString("aof_sharded:0\r\n")
+	}
+	if writeErr == nil {
+		sb.WriteString("aof_last_write_status:ok\r\n")
+	} else {
+		sb.WriteString("aof_last_write_status:err\r\n")
+		fmt.Fprintf(sb, "aof_last_write_error:%s\r\n", aofErrorCause(writeErr))
+		fmt.Fprintf(sb, "aof_last_write_error_since:%d\r\n", writeErrTime.Unix())
+	}
+	fmt.Fprintf(sb, "aof_current_size:%d\r\n", size)
+	fmt.Fprintf(sb, "aof_pending_bytes:%d\r\n", pending)
+}
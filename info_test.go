@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfoSections(t *testing.T) {
+	server := newTestServer(t, "")
+	executor := server.newExecutor()
+
+	info := executor.handleCommand(command("INFO")).bulk
+	for _, header := range []string{"# Server", "# Clients", "# Memory", "# Persistence", "# Stats", "# Keyspace"} {
+		if !strings.Contains(info, header+"\r\n") {
+			t.Errorf("Expected default INFO to contain %q", header)
+		}
+	}
+	if strings.Contains(info, "# Commandstats") {
+		t.Errorf("Expected commandstats to be left out of default INFO")
+	}
+
+	info = executor.handleCommand(command("INFO", "CLIENTS")).bulk
+	if !strings.HasPrefix(info, "# Clients\r\n") || strings.Contains(info, "# Server") {
+		t.Errorf("Expected only the clients section, got %q", info)
+	}
+}
+
+func TestInfoStats(t *testing.T) {
+	server := newTestServer(t, "")
+	executor := server.newExecutor()
+
+	executor.handleCommand(command("SET", "a", "1"))
+	executor.handleCommand(command("SET", "b", "2"))
+	executor.handleCommand(command("GET", "a"))
+	executor.handleCommand(command("MGET", "a", "missing"))
+	executor.handleCommand(command("SET", "a"))
+
+	info := executor.handleCommand(command("INFO", "stats", "keyspace", "commandstats", "errorstats")).bulk
+	for _, field := range []string{
+		"total_commands_processed:5\r\n",
+		"keyspace_hits:2\r\n",
+		"keyspace_misses:1\r\n",
+		"db0:keys=2,expires=0,avg_ttl=0\r\n",
+		"cmdstat_set:calls=3,",
+		"failed_calls=1\r\n",
+		"cmdstat_mget:calls=1,",
+		"errorstat_ERR:count=1\r\n",
+	} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected INFO to contain %q, got %q", field, info)
+		}
+	}
+
+	executor.handleCommand(command("CONFIG", "RESETSTAT"))
+	info = executor.handleCommand(command("INFO", "stats", "commandstats")).bulk
+	if !strings.Contains(info, "keyspace_hits:0\r\n") || strings.Contains(info, "cmdstat_set") {
+		t.Errorf("Expected CONFIG RESETSTAT to clear the stats, got %q", info)
+	}
+}
+
+func TestInfoMemory(t *testing.T) {
+	if _, err := os.Stat("/proc/self/statm"); err != nil {
+		t.Skip("needs /proc")
+	}
+	server := newTestServer(t, "")
+	info := server.newExecutor().handleCommand(command("INFO", "memory")).bulk
+	fields := map[string]uint64{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name], _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	rss, total := fields["used_memory_rss"], fields["total_system_memory"]
+	if rss == 0 || total <= rss {
+		t.Errorf("Expected an RSS below the system memory, got %d and %d in %q", rss, total, info)
+	}
+}
+
+func TestDebugShardStats(t *testing.T) {
+	kv := NewKV(4)
+	executor := NewExecutor(kv, nil)
+	executor.handleCommand(command("SET", "a", "1"))
+	executor.handleCommand(command("GET", "a"))
+
+	shard := kv.getShard("a")
+	if shard.stats.writes.Load() != 1 || shard.stats.reads.Load() != 1 {
+		t.Errorf("Expected 1 write and 1 read on the key's shard, got %d and %d", shard.stats.writes.Load(), shard.stats.reads.Load())
+	}
+	res := executor.handleCommand(command("DEBUG", "SHARDSTATS"))
+	want := fmt.Sprintf("shard_%d:keys=1,reads=1,writes=1,contended=0,", shard.id)
+	if !strings.HasPrefix(res.bulk, "shards:4\r\n") || !strings.Contains(res.bulk, want) {
+		t.Errorf("Expected DEBUG SHARDSTATS to contain %q, got %q", want, res.bulk)
+	}
+	if res := executor.handleCommand(command("INFO", "shardstats")); !strings.Contains(res.bulk, want) {
+		t.Errorf("Expected INFO shardstats to contain %q, got %q", want, res.bulk)
+	}
+}
+
+func TestShardLockTimingIsSampled(t *testing.T) {
+	shard := NewKV(1).shards[0]
+	timed := 0
+	for i := 0; i < 4*shardTimingSampleRate; i++ {
+		acquired := shard.acquire()
+		if !acquired.IsZero() {
+			timed++
+			time.Sleep(time.Millisecond)
+		}
+		shard.release(acquired)
+	}
+	if timed != 4 || shard.stats.writes.Load() != 4*shardTimingSampleRate {
+		t.Errorf("Expected 4 of %d acquisitions to be timed, got %d", shard.stats.writes.Load(), timed)
+	}
+	// sampled hold times are scaled up to estimate the total
+	if hold := time.Duration(shard.stats.writeHold.Load()); hold < 4*shardTimingSampleRate*time.Millisecond {
+		t.Errorf("Expected the hold time estimate to cover every acquisition, got %v", hold)
+	}
+}
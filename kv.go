@@ -1,22 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"hash/fnv"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type KV struct {
 	shards     []*Shard
 	shardCount int
+	// lookups that found / didn't find the key, for INFO
+	hits   atomic.Int64
+	misses atomic.Int64
 }
 
 type Shard struct {
 	store map[string]string
 	lock  sync.RWMutex
 	id    int
+	stats shardStats
 }
 
+// shardStats tracks how contended a shard's lock is. The acquisition
+// counts are exact, the times are in nanoseconds and estimated from one in
+// shardTimingSampleRate acquisitions so reading the clock stays off most
+// lock operations.
+type shardStats struct {
+	reads  atomic.Int64
+	writes atomic.Int64
+	// acquisitions that found the lock taken and had to wait
+	contended atomic.Int64
+	wait      atomic.Int64
+	readHold  atomic.Int64
+	writeHold atomic.Int64
+}
+
+const shardTimingSampleRate = 16
+
 func NewKV(shardCount int) *KV {
 	shards := make([]*Shard, shardCount)
 	for i := 0; i < shardCount; i++ {
@@ -31,14 +55,69 @@ func (kv *KV) getShard(key string) *Shard {
 	return kv.shards[int(h.Sum32())%kv.shardCount]
 }
 
+// acquire takes the shard's write lock. The returned time is when it got
+// it, or zero when the acquisition isn't timed, to be passed to release.
+func (s *Shard) acquire() time.Time {
+	start := s.startTiming(s.stats.writes.Add(1))
+	if !s.lock.TryLock() {
+		s.stats.contended.Add(1)
+		s.lock.Lock()
+	}
+	return s.acquired(start)
+}
+
+// startTiming returns the current time if the n-th acquisition is sampled
+func (s *Shard) startTiming(n int64) time.Time {
+	if n%shardTimingSampleRate != 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// acquired records the wait of a sampled acquisition and returns when the
+// lock was taken
+func (s *Shard) acquired(start time.Time) time.Time {
+	if start.IsZero() {
+		return start
+	}
+	now := time.Now()
+	s.stats.wait.Add(int64(now.Sub(start)) * shardTimingSampleRate)
+	return now
+}
+
+func (s *Shard) release(acquired time.Time) {
+	if !acquired.IsZero() {
+		s.stats.writeHold.Add(int64(time.Since(acquired)) * shardTimingSampleRate)
+	}
+	s.lock.Unlock()
+}
+
+// acquireRead is acquire for the read lock, to be paired with releaseRead
+func (s *Shard) acquireRead() time.Time {
+	start := s.startTiming(s.stats.reads.Add(1))
+	if !s.lock.TryRLock() {
+		s.stats.contended.Add(1)
+		s.lock.RLock()
+	}
+	return s.acquired(start)
+}
+
+func (s *Shard) releaseRead(acquired time.Time) {
+	if !acquired.IsZero() {
+		s.stats.readHold.Add(int64(time.Since(acquired)) * shardTimingSampleRate)
+	}
+	s.lock.RUnlock()
+}
+
 func (kv *KV) get(key string) Value {
 	shard := kv.getShard(key)
-	shard.lock.RLock()
-	defer shard.lock.RUnlock()
+	defer shard.releaseRead(shard.acquireRead())
 	val, ok := shard.store[key]
 	if !ok {
+		kv.misses.Add(1)
 		return Value{typ: "null"}
 	}
+	kv.hits.Add(1)
 	return Value{typ: "bulk", bulk: val}
 }
 
@@ -47,13 +126,15 @@ func (kv *KV) mget(keys []string) Value {
 	res.typ = "array"
 	for _, key := range keys {
 		shard := kv.getShard(key)
-		shard.lock.RLock()
+		acquired := shard.acquireRead()
 		val, ok := shard.store[key]
-		shard.lock.RUnlock()
+		shard.releaseRead(acquired)
 		if !ok {
+			kv.misses.Add(1)
 			res.array = append(res.array, Value{typ: "null"})
 			continue
 		}
+		kv.hits.Add(1)
 		res.array = append(res.array, Value{typ: "bulk", bulk: val})
 	}
 	return res
@@ -70,25 +151,23 @@ func (kv *KV) mset(pairs []KeyValuePair) {
 
 	// apply updates per shard
 	for shard, updates := range shardUpdates {
-		shard.lock.Lock()
+		acquired := shard.acquire()
 		for _, pair := range updates {
 			shard.store[pair.key] = pair.value
 		}
-		shard.lock.Unlock()
+		shard.release(acquired)
 	}
 }
 
 func (kv *KV) set(key string, val string) {
 	shard := kv.getShard(key)
-	shard.lock.Lock()
-	defer shard.lock.Unlock()
+	defer shard.release(shard.acquire())
 	shard.store[key] = val
 }
 
 func (kv *KV) setnx(key string, val string) Value {
 	shard := kv.getShard(key)
-	shard.lock.Lock()
-	defer shard.lock.Unlock()
+	defer shard.release(shard.acquire())
 	_, ok := shard.store[key]
 	// early return when data already exists
 	if ok {
@@ -109,7 +188,7 @@ func (kv *KV) del(keys []string) Value {
 	count := 0
 	// apply deletes per shard
 	for shard, keys := range shardKeys {
-		shard.lock.Lock()
+		acquired := shard.acquire()
 		for _, key := range keys {
 			_, ok := shard.store[key]
 			if ok {
@@ -117,7 +196,7 @@ func (kv *KV) del(keys []string) Value {
 				count++
 			}
 		}
-		shard.lock.Unlock()
+		shard.release(acquired)
 	}
 	return Value{typ: "integer", num: count}
 }
@@ -127,18 +206,18 @@ func (kv *KV) keys(pattern string) Value {
 	res.typ = "array"
 	res.array = []Value{}
 	for _, shard := range kv.shards {
-		shard.lock.RLock()
+		acquired := shard.acquireRead()
 		for key := range shard.store {
 			matched, err := path.Match(pattern, key)
 			if err != nil {
-				shard.lock.RUnlock()
+				shard.releaseRead(acquired)
 				return Value{typ: "error", str: "ERR invalid pattern"}
 			}
 			if matched {
 				res.array = append(res.array, Value{typ: "bulk", bulk: key})
 			}
 		}
-		shard.lock.RUnlock()
+		shard.releaseRead(acquired)
 	}
 	return res
 }
@@ -149,8 +228,7 @@ func (kv *KV) rename(oldKey string, newKey string) Value {
 
 	// Same shard optimization
 	if oldShard == newShard {
-		oldShard.lock.Lock()
-		defer oldShard.lock.Unlock()
+		defer oldShard.release(oldShard.acquire())
 		val, ok := oldShard.store[oldKey]
 		if !ok {
 			return Value{typ: "error", str: "ERR no such key"}
@@ -168,10 +246,8 @@ func (kv *KV) rename(oldKey string, newKey string) Value {
 		secondLock = oldShard
 	}
 
-	firstLock.lock.Lock()
-	defer firstLock.lock.Unlock()
-	secondLock.lock.Lock()
-	defer secondLock.lock.Unlock()
+	defer firstLock.release(firstLock.acquire())
+	defer secondLock.release(secondLock.acquire())
 
 	val, ok := oldShard.store[oldKey]
 	if !ok {
@@ -186,8 +262,41 @@ func (kv *KV) rename(oldKey string, newKey string) Value {
 
 func (kv *KV) Flush() {
 	for _, shard := range kv.shards {
-		shard.lock.Lock()
+		acquired := shard.acquire()
 		clear(shard.store)
-		shard.lock.Unlock()
+		shard.release(acquired)
+	}
+}
+
+// size returns the number of keys across all shards
+func (kv *KV) size() int {
+	n := 0
+	for _, shard := range kv.shards {
+		shard.lock.RLock()
+		n += len(shard.store)
+		shard.lock.RUnlock()
+	}
+	return n
+}
+
+func (st *shardStats) reset() {
+	st.reads.Store(0)
+	st.writes.Store(0)
+	st.contended.Store(0)
+	st.wait.Store(0)
+	st.readHold.Store(0)
+	st.writeHold.Store(0)
+}
+
+// writeShardStats writes one line of lock and key counts per shard
+func (kv *KV) writeShardStats(sb *strings.Builder) {
+	for _, shard := range kv.shards {
+		shard.lock.RLock()
+		keys := len(shard.store)
+		shard.lock.RUnlock()
+		st := &shard.stats
+		fmt.Fprintf(sb, "shard_%d:keys=%d,reads=%d,writes=%d,contended=%d,wait_usec=%d,read_hold_usec=%d,write_hold_usec=%d\r\n",
+			shard.id, keys, st.reads.Load(), st.writes.Load(), st.contended.Load(),
+			st.wait.Load()/1000, st.readHold.Load()/1000, st.writeHold.Load()/1000)
 	}
 }
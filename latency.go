@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// samples kept per event, one per second at most
+const latencyHistoryLen = 160
+
+type latencySample struct {
+	time time.Time
+	// milliseconds
+	latency int64
+}
+
+type latencyEvent struct {
+	// oldest sample first
+	history []latencySample
+	max     int64
+}
+
+// latencyMonitor samples events (slow commands, AOF writes, ...) that took
+// at least threshold milliseconds, like Redis' latency monitor.
+type latencyMonitor struct {
+	// milliseconds, 0 disables sampling
+	threshold atomic.Int64
+	lock      sync.Mutex
+	events    map[string]*latencyEvent
+}
+
+func newLatencyMonitor(threshold int) *latencyMonitor {
+	m := &latencyMonitor{events: make(map[string]*latencyEvent)}
+	m.threshold.Store(int64(threshold))
+	return m
+}
+
+// add records d for event if it reached the threshold. Samples in the same
+// second are merged, keeping the highest.
+func (m *latencyMonitor) add(event string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	threshold := m.threshold.Load()
+	latency := d.Milliseconds()
+	if threshold == 0 || latency < threshold {
+		return
+	}
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ev := m.events[event]
+	if ev == nil {
+		ev = &latencyEvent{}
+		m.events[event] = ev
+	}
+	ev.max = max(ev.max, latency)
+	if n := len(ev.history); n > 0 && ev.history[n-1].time.Unix() == now.Unix() {
+		last := &ev.history[n-1]
+		last.latency = max(last.latency, latency)
+		return
+	}
+	ev.history = append(ev.history, latencySample{time: now, latency: latency})
+	if len(ev.history) > latencyHistoryLen {
+		ev.history = append([]latencySample(nil), ev.history[1:]...)
+	}
+}
+
+// reset forgets the given events, or every event without arguments, and
+// returns how many were dropped
+func (m *latencyMonitor) reset(events []string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(events) == 0 {
+		n := len(m.events)
+		clear(m.events)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// eventNames returns the sampled events, caller must hold m.lock
+func (m *latencyMonitor) eventNames() []string {
+	names := make([]string, 0, len(m.events))
+	for name := range m.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *Executor) handleLatencyCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'latency' command"}
+	}
+	if e.server == nil {
+		return Value{typ: "error", str: "ERR LATENCY is not available"}
+	}
+	m := e.server.latency
+	args := array[1:]
+	switch strings.ToUpper(array[0].bulk) {
+	case "LATEST":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'latency|latest' command"}
+		}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		res := Value{typ: "array", array: []Value{}}
+		for _, name := range m.eventNames() {
+			ev := m.events[name]
+			last := ev.history[len(ev.history)-1]
+			res.array = append(res.array, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: name},
+				{typ: "integer", num: int(last.time.Unix())},
+				{typ: "integer", num: int(last.latency)},
+				{typ: "integer", num: int(ev.max)},
+			}})
+		}
+		return res
+	case "HISTORY":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'latency|history' command"}
+		}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		res := Value{typ: "array", array: []Value{}}
+		if ev := m.events[args[0].bulk]; ev != nil {
+			for _, sample := range ev.history {
+				res.array = append(res.array, Value{typ: "array", array: []Value{
+					{typ: "integer", num: int(sample.time.Unix())},
+					{typ: "integer", num: int(sample.latency)},
+				}})
+			}
+		}
+		return res
+	case "RESET":
+		events := make([]string, len(args))
+		for i, arg := range args {
+			events[i] = arg.bulk
+		}
+		return Value{typ: "integer", num: m.reset(events)}
+	case "HISTOGRAM":
+		return e.server.latencyHistogram(args)
+	case "DOCTOR":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'latency|doctor' command"}
+		}
+		return Value{typ: "verbatim", str: "txt", bulk: m.doctor()}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try LATENCY HELP.", array[0].bulk)}
+	}
+}
+
+// latencyHistogram replies with the calls and cumulative power-of-two
+// microsecond buckets of the given commands, or of every command that ran
+func (s *Server) latencyHistogram(args []Value) Value {
+	var specs []*commandSpec
+	if len(args) == 0 {
+		for spec := range s.stats.commands {
+			specs = append(specs, spec)
+		}
+	} else {
+		for _, arg := range args {
+			if spec := lookupCommand(strings.ToUpper(arg.bulk)); spec != nil {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+
+	res := Value{typ: "map", array: []Value{}}
+	for i, spec := range specs {
+		if i > 0 && specs[i-1] == spec {
+			continue
+		}
+		h := &s.stats.commands[spec].latency
+		calls := h.count.Load()
+		if calls == 0 {
+			continue
+		}
+		buckets := Value{typ: "map", array: []Value{}}
+		var cumulative int64
+		for b := 0; b <= histogramBuckets; b++ {
+			count := h.buckets[b].Load()
+			if count == 0 {
+				continue
+			}
+			cumulative += count
+			// the overflow bucket is reported as the next power of two
+			bound := histogramBound(b).Microseconds()
+			buckets.array = append(buckets.array, Value{typ: "integer", num: int(bound)}, Value{typ: "integer", num: int(cumulative)})
+		}
+		res.array = append(res.array,
+			Value{typ: "bulk", bulk: spec.name},
+			Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "calls"},
+				{typ: "integer", num: int(calls)},
+				{typ: "bulk", bulk: "histogram_usec"},
+				buckets,
+			}})
+	}
+	return res
+}
+
+// advice on what usually causes latency for each event
+var latencyAdvice = map[string]string{
+	"command":            "Some commands are slow. Check SLOWLOG GET for the worst ones; KEYS and large MSET/MGET/DEL calls are the usual suspects.",
+	"keys-scan":          "KEYS walks every shard while holding its lock. Avoid it in production, or use patterns that match fewer keys and keep the dataset small.",
+	"aof-write":          "Writing to the AOF is slow, the disk may be saturated or shared with other processes. Consider faster storage or aof-sharded yes to spread writes over several files.",
+	"aof-fsync-always":   "With appendfsync always every write waits for fsync. Consider appendfsync everysec, which loses at most one second of writes on a crash.",
+	"aof-fsync-everysec": "The background fsync is slow, which usually means the disk can't keep up with the write load. Consider faster storage or appendfsync no.",
+}
+
+// doctor explains the sampled events in plain text
+func (m *latencyMonitor) doctor() string {
+	var sb strings.Builder
+	if m.threshold.Load() == 0 {
+		sb.WriteString("The latency monitor is disabled. Enable it with CONFIG SET latency-monitor-threshold <milliseconds> and ask again once the server has seen some load.\n")
+		return sb.String()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := m.eventNames()
+	if len(names) == 0 {
+		fmt.Fprintf(&sb, "No latency spikes of %dms or more were observed. The server looks healthy.\n", m.threshold.Load())
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "Latency spikes of %dms or more were observed for %d event(s):\n\n", m.threshold.Load(), len(names))
+	for i, name := range names {
+		ev := m.events[name]
+		var sum int64
+		for _, sample := range ev.history {
+			sum += sample.latency
+		}
+		first, last := ev.history[0].time, ev.history[len(ev.history)-1].time
+		fmt.Fprintf(&sb, "%d. %s: %d latency spikes (average %dms, max %dms) between %s and %s.\n",
+			i+1, name, len(ev.history), sum/int64(len(ev.history)), ev.max,
+			first.Format(time.DateTime), last.Format(time.DateTime))
+	}
+	sb.WriteString("\nSuggestions:\n\n")
+	for _, name := range names {
+		advice, ok := latencyAdvice[name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&sb, "- %s\n", advice)
+	}
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyMonitor(t *testing.T) {
+	server := newTestServer(t, "latency-monitor-threshold 10\n")
+	executor := server.newExecutor()
+
+	server.latency.add("aof-write", 5*time.Millisecond)
+	server.latency.add("aof-write", 20*time.Millisecond)
+	server.latency.add("aof-write", 15*time.Millisecond)
+
+	res := executor.handleCommand(command("LATENCY", "LATEST"))
+	if len(res.array) != 1 {
+		t.Fatalf("Expected one event, got %v", res.array)
+	}
+	latest := res.array[0].array
+	if latest[0].bulk != "aof-write" || latest[2].num != 20 || latest[3].num != 20 {
+		t.Errorf("Expected aof-write at 20ms, got %v", latest)
+	}
+	// samples within the same second are merged
+	if res := executor.handleCommand(command("LATENCY", "HISTORY", "aof-write")); len(res.array) != 1 {
+		t.Errorf("Expected a single sample, got %v", res.array)
+	}
+	doctor := executor.handleCommand(command("LATENCY", "DOCTOR")).bulk
+	if !strings.Contains(doctor, "aof-write: 1 latency spikes") || !strings.Contains(doctor, latencyAdvice["aof-write"]) {
+		t.Errorf("Expected DOCTOR to explain the aof-write spike, got %q", doctor)
+	}
+	if res := executor.handleCommand(command("LATENCY", "RESET")); res.num != 1 {
+		t.Errorf("Expected RESET to drop 1 event, got %d", res.num)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	server := newTestServer(t, "")
+	executor := server.newExecutor()
+	executor.handleCommand(command("GET", "a"))
+	executor.handleCommand(command("GET", "b"))
+
+	res := executor.handleCommand(command("LATENCY", "HISTOGRAM", "get", "set"))
+	if len(res.array) != 2 || res.array[0].bulk != "get" {
+		t.Fatalf("Expected only get to be reported, got %v", res.array)
+	}
+	fields := res.array[1].array
+	if fields[1].num != 2 {
+		t.Errorf("Expected 2 calls, got %d", fields[1].num)
+	}
+	buckets := fields[3].array
+	if len(buckets) == 0 || buckets[len(buckets)-1].num != 2 {
+		t.Errorf("Expected the last cumulative bucket to count both calls, got %v", buckets)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// listen opens every configured listener: TCP and TLS on each bind address
+// and the unix socket. Every listener is served by the same accept loop.
+func (s *Server) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	if s.config.port != 0 {
+		addrs, optional := s.config.addresses(s.config.port)
+		for i, addr := range addrs {
+			l, err := net.Listen("tcp", addr)
+			if err != nil && optional[i] {
+				logWarningf("skipping bind address %s: %v", addr, err)
+				continue
+			}
+			if err != nil {
+				return fail(fmt.Errorf("error listening on %s: %w", addr, err))
+			}
+			logNoticef("Listening on %s", l.Addr())
+			listeners = append(listeners, l)
+		}
+	}
+	if s.config.tlsPort != 0 {
+		addrs, optional := s.config.addresses(s.config.tlsPort)
+		for i, addr := range addrs {
+			l, err := s.tls.listen(addr)
+			if err != nil && optional[i] {
+				logWarningf("skipping TLS bind address %s: %v", addr, err)
+				continue
+			}
+			if err != nil {
+				return fail(fmt.Errorf("error listening for TLS on %s: %w", addr, err))
+			}
+			logNoticef("Listening for TLS on %s", l.Addr())
+			listeners = append(listeners, l)
+		}
+	}
+	if s.config.unixsocket != "" {
+		l, err := listenUnix(s.config.unixsocket, fs.FileMode(s.config.unixsocketperm))
+		if err != nil {
+			return fail(fmt.Errorf("error listening on unix socket %s: %w", s.config.unixsocket, err))
+		}
+		logNoticef("Listening on unix socket %s", s.config.unixsocket)
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("none of the bind addresses could be listened on")
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a unix socket, replacing a stale socket file left by
+// a previous run. perm 0 keeps the permissions the umask gives.
+func listenUnix(path string, perm fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
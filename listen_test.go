@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a TCP port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenBindAndUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "redis.sock")
+	// a stale socket file from a previous run is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	port := freePort(t)
+	// the unroutable address is skipped because of its leading -
+	server := newTestServer(t, "port "+strconv.Itoa(port)+"\nbind 127.0.0.1 -192.0.2.1\nunixsocket "+socket+"\nunixsocketperm 700\n")
+	listeners, err := server.listen()
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Expected a TCP and a unix listener, got %d", len(listeners))
+	}
+	go server.serve(listeners)
+	t.Cleanup(func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	})
+
+	info, err := os.Stat(socket)
+	if err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("Expected the socket to have mode 0700, got %v (%v)", info.Mode(), err)
+	}
+
+	for _, dial := range []struct{ network, addr, flags string }{
+		{"tcp", "127.0.0.1:" + strconv.Itoa(port), " flags=N "},
+		{"unix", socket, " flags=NU "},
+	} {
+		conn, err := net.DialTimeout(dial.network, dial.addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect over %s: %v", dial.network, err)
+		}
+		defer conn.Close()
+		c := &testConn{conn: conn, parser: &RespParser{reader: bufio.NewReader(conn)}}
+		if info := c.do(t, "CLIENT", "INFO").bulk; !strings.Contains(info, dial.flags) {
+			t.Errorf("Expected %q in the CLIENT INFO of a %s client, got %q", dial.flags, dial.network, info)
+		}
+	}
+}
+
+func TestBindList(t *testing.T) {
+	config, _, err := parseConfig([]string{"--bind", "127.0.0.1 -::1", "--port", "7000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, optional := config.addresses(config.port)
+	if strings.Join(addrs, ",") != "127.0.0.1:7000,[::1]:7000" || optional[0] || !optional[1] {
+		t.Errorf("Unexpected addresses %v %v", addrs, optional)
+	}
+	if _, _, err := parseConfig([]string{"--port", "0"}); err == nil {
+		t.Errorf("Expected a config without any listener to be rejected")
+	}
+}
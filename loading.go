@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadingState tracks AOF replay progress so clients connected during startup
+// can be answered with -LOADING and INFO can report how far along it is
+type loadingState struct {
+	active    atomic.Bool
+	startTime atomic.Int64
+	// bytes read from the AOF files, including encryption framing
+	totalBytes  atomic.Int64
+	loadedBytes atomic.Int64
+	commands    atomic.Int64
+}
+
+// start marks the dataset as loading. It's a no-op if loading already
+// started, so main can flag it before the replay goroutine runs.
+func (l *loadingState) start(totalBytes int64) {
+	if l.active.Load() {
+		return
+	}
+	l.startTime.Store(time.Now().UnixNano())
+	l.totalBytes.Store(totalBytes)
+	l.loadedBytes.Store(0)
+	l.commands.Store(0)
+	l.active.Store(true)
+}
+
+func (l *loadingState) finish() {
+	l.active.Store(false)
+}
+
+// track wraps an AOF reader so the bytes it returns count as loaded
+func (l *loadingState) track(r io.Reader) io.Reader {
+	return &progressReader{r: r, loaded: &l.loadedBytes}
+}
+
+type progressReader struct {
+	r      io.Reader
+	loaded *atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.loaded.Add(int64(n))
+	return n, err
+}
+
+func (l *loadingState) writeInfo(sb *strings.Builder) {
+	if !l.active.Load() {
+		sb.WriteString("loading:0\r\n")
+		return
+	}
+	start := time.Unix(0, l.startTime.Load())
+	total := l.totalBytes.Load()
+	loaded := l.loadedBytes.Load()
+	perc := 0.0
+	if total > 0 {
+		perc = float64(loaded) / float64(total) * 100
+	}
+	// extrapolate from the rate so far
+	eta := 1
+	elapsed := time.Since(start).Seconds()
+	if loaded > 0 {
+		eta = int(elapsed * float64(total-loaded) / float64(loaded))
+	}
+	sb.WriteString("loading:1\r\n")
+	fmt.Fprintf(sb, "loading_start_time:%d\r\n", start.Unix())
+	fmt.Fprintf(sb, "loading_total_bytes:%d\r\n", total)
+	fmt.Fprintf(sb, "loading_loaded_bytes:%d\r\n", loaded)
+	fmt.Fprintf(sb, "loading_loaded_perc:%.2f\r\n", perc)
+	fmt.Fprintf(sb, "loading_eta_seconds:%d\r\n", eta)
+	fmt.Fprintf(sb, "loading_loaded_commands:%d\r\n", l.commands.Load())
+}
+
+// loadSize returns the number of bytes replayed on startup
+func (aof *AOF) loadSize() int64 {
+	var total int64
+	files := aof.files
+	if aof.legacy != nil {
+		files = append([]*aofFile{aof.legacy}, files...)
+	}
+	for _, f := range files {
+		f.lock.RLock()
+		total += f.size
+		f.lock.RUnlock()
+	}
+	return total
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// log levels, in increasing order of importance
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+var logLevelNames = []string{"debug", "verbose", "notice", "warning"}
+
+// redis-style markers shown in front of each message
+var logLevelMarks = []byte{'.', '-', '*', '#'}
+
+type serverLogger struct {
+	level atomic.Int32
+	lock  sync.Mutex
+	out   io.Writer
+}
+
+var logger = newServerLogger()
+
+func newServerLogger() *serverLogger {
+	l := &serverLogger{out: os.Stdout}
+	l.level.Store(logNotice)
+	return l
+}
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+func (l *serverLogger) setLevel(level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	l.level.Store(int32(parsed))
+	return nil
+}
+
+// configure applies the loglevel and logfile settings
+func (l *serverLogger) configure(level string, logfile string) error {
+	if _, err := parseLogLevel(level); err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if logfile != "" {
+		file, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("can't open the log file: %w", err)
+		}
+		out = file
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if closer, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		closer.Close()
+	}
+	l.out = out
+	return l.setLevel(level)
+}
+
+func (l *serverLogger) logf(level int, format string, args ...any) {
+	if int32(level) < l.level.Load() {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	fmt.Fprintf(l.out, "%d:M %s %c %s\n", os.Getpid(), now.Format("02 Jan 2006 15:04:05.000"), logLevelMarks[level], msg)
+}
+
+func logDebugf(format string, args ...any) {
+	logger.logf(logDebug, format, args...)
+}
+
+func logVerbosef(format string, args ...any) {
+	logger.logf(logVerbose, format, args...)
+}
+
+func logNoticef(format string, args ...any) {
+	logger.logf(logNotice, format, args...)
+}
+
+func logWarningf(format string, args ...any) {
+	logger.logf(logWarning, format, args...)
+}
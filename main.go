@@ -1,90 +1,102 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Listening on port :6379")
-	l, err := net.Listen("tcp", ":6379")
+	config, configFile, err := parseConfig(os.Args[1:])
 	if err != nil {
-		fmt.Println(err)
-		return
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "*** FATAL CONFIG ERROR ***\n%v\n", err)
+		os.Exit(1)
+	}
+	if err := logger.configure(config.loglevel, config.logfile); err != nil {
+		fmt.Fprintf(os.Stderr, "*** FATAL CONFIG ERROR ***\n%v\n", err)
+		os.Exit(1)
+	}
+	if configFile != "" {
+		logNoticef("Configuration loaded from %s", configFile)
 	}
 
-	// create a kv instance with 16 shard counts
-	kvDatabase := NewKV(16)
-
-	// initialize AOF
-	aof, err := newAOF("append-only.aof")
+	server, err := newServer(config, configFile)
 	if err != nil {
-		fmt.Println("error initializing AOF:", err)
-		return
+		logWarningf("error initializing server: %v", err)
+		os.Exit(1)
 	}
-	defer aof.Close()
+	defer server.aof.Close()
 
-	// load AOF file if it exists
-	loadAOF(kvDatabase, aof)
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				fmt.Printf("accept temp error: %v\n", err)
-				continue
+	listeners, err := server.listen()
+	if err != nil {
+		logWarningf("%v", err)
+		os.Exit(1)
+	}
+	if config.tlsPort != 0 {
+		// SIGHUP reloads the certificates, e.g. after they were renewed
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				server.reloadTLS()
 			}
+		}()
+	}
 
-			fmt.Printf("accept error: %v\n", err)
-			return
+	if config.metricsPort != 0 {
+		ml, err := net.Listen("tcp", config.metricsAddress())
+		if err != nil {
+			logWarningf("error listening for metrics on %s: %v", config.metricsAddress(), err)
+			os.Exit(1)
 		}
-		go handleConnection(conn, kvDatabase, aof)
+		logNoticef("Serving metrics on http://%s/metrics", ml.Addr())
+		go func() {
+			if err := server.serveMetrics(ml); err != nil {
+				logWarningf("metrics listener stopped: %v", err)
+			}
+		}()
 	}
+
+	// replay the AOF in the background, clients get -LOADING until it's done.
+	// flag it here so nobody connecting before the goroutine starts sees an empty dataset
+	server.aof.loading.start(server.aof.loadSize())
+	go loadAOF(server.db, server.aof)
+	server.serve(listeners)
 }
 
 func loadAOF(kvDatabase *KV, aof *AOF) {
-	aofParser := newRespParser(aof.file)
+	aof.loading.start(aof.loadSize())
+	defer aof.loading.finish()
+	start := time.Now()
+	if aof.kv != nil {
+		loadShardedAOF(kvDatabase, aof)
+	} else {
+		replayAOFFile(kvDatabase, aof.files[0], &aof.loading)
+	}
+	logNoticef("DB loaded from append only file: %d commands in %.3f seconds", aof.loading.commands.Load(), time.Since(start).Seconds())
+}
+
+func replayAOFFile(kvDatabase *KV, f *aofFile, loading *loadingState) {
+	aofParser := newRespParser(f.reader(loading))
 	// pass aof pointer as nil because we don't want to write to aof while reading from it
 	executor := NewExecutor(kvDatabase, nil)
 	for {
 		val, err := aofParser.readResp()
 		if err != nil {
-			if err == io.EOF {
-				break
+			if err != io.EOF {
+				repairAOFTail(f, err)
 			}
-			fmt.Println("error reading from AOF: ", err.Error())
 			break
 		}
 		executor.handleCommand(val)
-	}
-}
-
-func handleConnection(conn net.Conn, kvDatabase *KV, aof *AOF) {
-	defer conn.Close()
-	parser := newRespParser(conn)
-	executor := NewExecutor(kvDatabase, aof)
-	writer := bufio.NewWriter(conn)
-	for {
-		// kilobyte-size buffer to read messages from client
-		val, err := parser.readResp()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Println("error reading from client: ", err.Error())
-			break
-		}
-		responseVal := executor.handleCommand(val)
-		if responseVal.typ == "quit" {
-			break
-		}
-		respBytes := responseVal.Marshal()
-		_, err = conn.Write(respBytes)
-		if err != nil {
-			fmt.Println("error writing to client: ", err.Error())
-			break
-		}
-		writer.Flush()
+		loading.commands.Add(1)
 	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// serveMetrics answers Prometheus scrapes on /metrics until the listener fails
+func (s *Server) serveMetrics(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return srv.Serve(l)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.writeMetrics(bw)
+	bw.Flush()
+}
+
+// writeMetrics writes every metric in the Prometheus text exposition format
+func (s *Server) writeMetrics(w io.Writer) {
+	st := s.stats
+	metricHeader(w, "redis_uptime_seconds", "gauge", "Seconds since the server started.")
+	fmt.Fprintf(w, "redis_uptime_seconds %d\n", int64(time.Since(s.startTime).Seconds()))
+
+	metricHeader(w, "redis_connected_clients", "gauge", "Number of client connections.")
+	fmt.Fprintf(w, "redis_connected_clients %d\n", st.connectedClients.Load())
+	metricHeader(w, "redis_connections_received_total", "counter", "Connections accepted by the server.")
+	fmt.Fprintf(w, "redis_connections_received_total %d\n", st.connectionsReceived.Load())
+	metricHeader(w, "redis_net_input_bytes_total", "counter", "Bytes read from clients.")
+	fmt.Fprintf(w, "redis_net_input_bytes_total %d\n", st.netInputBytes.Load())
+	metricHeader(w, "redis_net_output_bytes_total", "counter", "Bytes written to clients.")
+	fmt.Fprintf(w, "redis_net_output_bytes_total %d\n", st.netOutputBytes.Load())
+
+	specs := make([]*commandSpec, 0, len(st.commands))
+	for spec := range st.commands {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+	metricHeader(w, "redis_commands_total", "counter", "Commands executed.")
+	for _, spec := range specs {
+		fmt.Fprintf(w, "redis_commands_total{cmd=%q} %d\n", spec.name, st.commands[spec].calls.Load())
+	}
+	metricHeader(w, "redis_commands_rejected_total", "counter", "Commands refused before running.")
+	for _, spec := range specs {
+		fmt.Fprintf(w, "redis_commands_rejected_total{cmd=%q} %d\n", spec.name, st.commands[spec].rejected.Load())
+	}
+	metricHeader(w, "redis_commands_failed_total", "counter", "Commands that replied with an error.")
+	for _, spec := range specs {
+		fmt.Fprintf(w, "redis_commands_failed_total{cmd=%q} %d\n", spec.name, st.commands[spec].failed.Load())
+	}
+	metricHeader(w, "redis_command_duration_seconds", "histogram", "Time spent executing commands.")
+	for _, spec := range specs {
+		writeHistogram(w, "redis_command_duration_seconds", fmt.Sprintf("cmd=%q", spec.name), &st.commands[spec].latency)
+	}
+
+	metricHeader(w, "redis_keyspace_hits_total", "counter", "Key lookups that found the key.")
+	fmt.Fprintf(w, "redis_keyspace_hits_total %d\n", s.db.hits.Load())
+	metricHeader(w, "redis_keyspace_misses_total", "counter", "Key lookups that didn't find the key.")
+	fmt.Fprintf(w, "redis_keyspace_misses_total %d\n", s.db.misses.Load())
+	metricHeader(w, "redis_shard_keys", "gauge", "Number of keys in each shard.")
+	for _, shard := range s.db.shards {
+		shard.lock.RLock()
+		keys := len(shard.store)
+		shard.lock.RUnlock()
+		fmt.Fprintf(w, "redis_shard_keys{shard=\"%d\"} %d\n", shard.id, keys)
+	}
+	metricHeader(w, "redis_shard_lock_acquisitions_total", "counter", "Lock acquisitions on each shard, by mode.")
+	for _, shard := range s.db.shards {
+		fmt.Fprintf(w, "redis_shard_lock_acquisitions_total{shard=\"%d\",mode=\"read\"} %d\n", shard.id, shard.stats.reads.Load())
+		fmt.Fprintf(w, "redis_shard_lock_acquisitions_total{shard=\"%d\",mode=\"write\"} %d\n", shard.id, shard.stats.writes.Load())
+	}
+	metricHeader(w, "redis_shard_lock_contended_total", "counter", "Lock acquisitions that had to wait for another holder.")
+	for _, shard := range s.db.shards {
+		fmt.Fprintf(w, "redis_shard_lock_contended_total{shard=\"%d\"} %d\n", shard.id, shard.stats.contended.Load())
+	}
+	metricHeader(w, "redis_shard_lock_wait_seconds_total", "counter", "Time spent waiting for each shard's lock.")
+	for _, shard := range s.db.shards {
+		fmt.Fprintf(w, "redis_shard_lock_wait_seconds_total{shard=\"%d\"} %s\n", shard.id, seconds(time.Duration(shard.stats.wait.Load())))
+	}
+	metricHeader(w, "redis_shard_lock_hold_seconds_total", "counter", "Time each shard's lock was held, by mode.")
+	for _, shard := range s.db.shards {
+		fmt.Fprintf(w, "redis_shard_lock_hold_seconds_total{shard=\"%d\",mode=\"read\"} %s\n", shard.id, seconds(time.Duration(shard.stats.readHold.Load())))
+		fmt.Fprintf(w, "redis_shard_lock_hold_seconds_total{shard=\"%d\",mode=\"write\"} %s\n", shard.id, seconds(time.Duration(shard.stats.writeHold.Load())))
+	}
+
+	m := &s.aof.metrics
+	metricHeader(w, "redis_aof_write_duration_seconds", "histogram", "Time spent writing to the AOF.")
+	writeHistogram(w, "redis_aof_write_duration_seconds", "", &m.write)
+	metricHeader(w, "redis_aof_fsync_duration_seconds", "histogram", "Time spent fsyncing the AOF.")
+	writeHistogram(w, "redis_aof_fsync_duration_seconds", "", &m.fsync)
+	metricHeader(w, "redis_aof_written_bytes_total", "counter", "Bytes written to the AOF.")
+	fmt.Fprintf(w, "redis_aof_written_bytes_total %d\n", m.writtenBytes.Load())
+	metricHeader(w, "redis_aof_write_failing", "gauge", "Whether AOF writes are currently failing.")
+	failing := 0
+	if s.aof.writeError() != nil {
+		failing = 1
+	}
+	fmt.Fprintf(w, "redis_aof_write_failing %d\n", failing)
+	metricHeader(w, "redis_loading", "gauge", "Whether the AOF is still being replayed.")
+	loading := 0
+	if s.aof.loading.active.Load() {
+		loading = 1
+	}
+	fmt.Fprintf(w, "redis_loading %d\n", loading)
+	// replication lag will be exported here once replication exists
+}
+
+func metricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of h. labels
+// are added to every sample, e.g. cmd="get".
+func writeHistogram(w io.Writer, name, labels string, h *latencyHistogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative int64
+	for i := 0; i < histogramBuckets; i++ {
+		cumulative += h.buckets[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, seconds(histogramBound(i)), cumulative)
+	}
+	cumulative += h.buckets[histogramBuckets].Load()
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, seconds(time.Duration(h.sum.Load())))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, cumulative)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
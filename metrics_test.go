@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Microsecond, 0},
+		{2 * time.Microsecond, 1},
+		{3 * time.Microsecond, 2},
+		{1024 * time.Microsecond, 10},
+		{1025 * time.Microsecond, 11},
+		{time.Hour, histogramBuckets},
+	}
+	for _, test := range tests {
+		if got := histogramBucket(test.d); got != test.want {
+			t.Errorf("histogramBucket(%v) = %d, want %d", test.d, got, test.want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := newTestServer(t, "")
+	executor := server.newExecutor()
+	executor.handleCommand(command("SET", "a", "1"))
+	executor.handleCommand(command("GET", "a"))
+
+	rec := httptest.NewRecorder()
+	server.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	metrics := string(body)
+	for _, line := range []string{
+		"# TYPE redis_command_duration_seconds histogram\n",
+		`redis_commands_total{cmd="set"} 1` + "\n",
+		`redis_command_duration_seconds_bucket{cmd="get",le="+Inf"} 1` + "\n",
+		`redis_command_duration_seconds_count{cmd="get"} 1` + "\n",
+		"redis_keyspace_hits_total 1\n",
+		"redis_aof_write_duration_seconds_count 1\n",
+		"redis_aof_written_bytes_total ",
+		`redis_shard_keys{shard="0"} `,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected /metrics to contain %q", line)
+		}
+	}
+}
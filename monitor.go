@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lines buffered per monitor before it's considered too slow and dropped
+const monitorBufferLen = 1024
+
+// monitorHub fans out every executed command to the connections in MONITOR
+// mode. Feeding never blocks: a monitor whose buffer is full is disconnected
+// so it can't stall the clients it's watching.
+type monitorHub struct {
+	lock     sync.RWMutex
+	monitors map[chan string]struct{}
+	// fast path so executors skip formatting when nobody is watching
+	count atomic.Int32
+}
+
+func newMonitorHub() *monitorHub {
+	return &monitorHub{monitors: make(map[chan string]struct{})}
+}
+
+func (h *monitorHub) subscribe() chan string {
+	ch := make(chan string, monitorBufferLen)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.monitors[ch] = struct{}{}
+	h.count.Add(1)
+	return ch
+}
+
+// unsubscribe removes and closes ch, it's a no-op if it's already gone
+func (h *monitorHub) unsubscribe(ch chan string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.monitors[ch]; !ok {
+		return
+	}
+	delete(h.monitors, ch)
+	h.count.Add(-1)
+	close(ch)
+}
+
+// feed sends a command to every monitor
+func (h *monitorHub) feed(client *Client, input Value) {
+	if h.count.Load() == 0 {
+		return
+	}
+	line := formatMonitorLine(time.Now(), client, input)
+	var slow []chan string
+	h.lock.RLock()
+	for ch := range h.monitors {
+		select {
+		case ch <- line:
+		default:
+			slow = append(slow, ch)
+		}
+	}
+	h.lock.RUnlock()
+	for _, ch := range slow {
+		logVerbosef("disconnecting MONITOR client that can't keep up")
+		h.unsubscribe(ch)
+	}
+}
+
+// formatMonitorLine builds the status reply monitors receive, e.g.
+// +1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value"
+func formatMonitorLine(now time.Time, client *Client, input Value) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "+%d.%06d [0 ", now.Unix(), now.Nanosecond()/1000)
+	if client != nil {
+		sb.WriteString(client.addr)
+	} else {
+		sb.WriteString("internal")
+	}
+	sb.WriteByte(']')
+	for _, arg := range input.array {
+		sb.WriteByte(' ')
+		sb.WriteString(reprString(arg.bulk))
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// monitor streams commands to conn until the client quits or falls behind.
+// Commands other than QUIT sent in monitor mode are ignored.
+func (s *Server) monitor(conn net.Conn, parser *RespParser) {
+	ch := s.monitors.subscribe()
+	defer s.monitors.unsubscribe(ch)
+
+	quit := make(chan struct{})
+	go func() {
+		defer close(quit)
+		for {
+			val, err := parser.readCommand()
+			if err != nil {
+				return
+			}
+			if val.typ == "array" && len(val.array) > 0 && strings.EqualFold(val.array[0].bulk, "QUIT") {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			n, err := conn.Write([]byte(line))
+			s.stats.netOutputBytes.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
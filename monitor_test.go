@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMonitorLine(t *testing.T) {
+	now := time.Unix(1339518083, 107412000)
+	client := &Client{addr: "127.0.0.1:60866"}
+	line := formatMonitorLine(now, client, command("SET", "key", "a \"b\"\n"))
+	want := "+1339518083.107412 [0 127.0.0.1:60866] \"SET\" \"key\" \"a \\\"b\\\"\\n\"\r\n"
+	if line != want {
+		t.Errorf("Expected %q, got %q", want, line)
+	}
+}
+
+func TestMonitorDropsSlowMonitor(t *testing.T) {
+	hub := newMonitorHub()
+	ch := hub.subscribe()
+	for i := 0; i <= monitorBufferLen; i++ {
+		hub.feed(nil, command("PING"))
+	}
+	if hub.count.Load() != 0 {
+		t.Errorf("Expected the full monitor to be dropped")
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != monitorBufferLen {
+		t.Errorf("Expected %d buffered lines before the monitor was closed, got %d", monitorBufferLen, n)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	server := newTestServer(t, "")
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go server.handleConnection(peer)
+	reader := bufio.NewReader(conn)
+
+	conn.Write(command("MONITOR").Marshal())
+	if line, _ := reader.ReadString('\n'); line != "+OK\r\n" {
+		t.Fatalf("Expected +OK, got %q", line)
+	}
+	// wait for the connection to subscribe
+	for server.monitors.count.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	executor := server.newExecutor()
+	executor.client = &Client{addr: "10.0.0.1:1234", user: "default", authenticated: true}
+	executor.handleCommand(command("GET", "k"))
+
+	line, _ := reader.ReadString('\n')
+	if !strings.HasSuffix(line, " [0 10.0.0.1:1234] \"GET\" \"k\"\r\n") {
+		t.Errorf("Expected the GET to be streamed, got %q", line)
+	}
+}
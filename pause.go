@@ -0,0 +1,155 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type pauseMode int
+
+const (
+	pauseNone pauseMode = iota
+	// hold write commands, reads keep being served
+	pauseWrite
+	// hold every command
+	pauseAll
+)
+
+// pauseState implements CLIENT PAUSE. Held commands wait in their
+// connection goroutine and are resumed one at a time in the order they
+// arrived, so the backlog runs in the same order it was sent.
+type pauseState struct {
+	lock  sync.Mutex
+	mode  pauseMode
+	until time.Time
+	timer *time.Timer
+	// bumped on every pause and unpause so a stale timer can't end a newer pause
+	generation int
+	// channels of the held commands, oldest first
+	queue []chan struct{}
+}
+
+// pause holds commands matching mode for d. An active pause is only ever
+// made longer or stricter.
+func (p *pauseState) pause(mode pauseMode, d time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	until := time.Now().Add(d)
+	if p.mode == pauseNone || until.After(p.until) {
+		p.until = until
+	}
+	p.mode = max(p.mode, mode)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.generation++
+	generation := p.generation
+	p.timer = time.AfterFunc(time.Until(p.until), func() { p.expire(generation) })
+}
+
+func (p *pauseState) expire(generation int) {
+	p.lock.Lock()
+	if p.generation != generation {
+		p.lock.Unlock()
+		return
+	}
+	// checked and reset under one lock hold, so a pause that starts in
+	// between can't be ended by this stale timer
+	p.unpauseLocked()
+	p.lock.Unlock()
+	p.releaseNext()
+}
+
+// unpause ends the pause and starts resuming the held commands
+func (p *pauseState) unpause() {
+	p.lock.Lock()
+	p.unpauseLocked()
+	p.lock.Unlock()
+	p.releaseNext()
+}
+
+// unpauseLocked ends the pause, caller must hold p.lock and call
+// releaseNext after releasing it
+func (p *pauseState) unpauseLocked() {
+	p.mode = pauseNone
+	p.generation++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+}
+
+// wait blocks while the command is paused, flagging the client as blocked.
+// held is true if the command was held, in which case the caller must call
+// releaseNext once it ran. dropped is true if the client went away while
+// held, the command must not run then.
+func (p *pauseState) wait(client *Client, spec *commandSpec, input Value) (held, dropped bool) {
+	p.lock.Lock()
+	if !p.holds(spec, input) {
+		p.lock.Unlock()
+		return false, false
+	}
+	ch := make(chan struct{})
+	p.queue = append(p.queue, ch)
+	client.blocked.Store(true)
+	p.lock.Unlock()
+	if client.onBlock != nil {
+		defer client.onBlock()()
+	}
+	defer client.blocked.Store(false)
+	select {
+	case <-ch:
+		return true, false
+	case <-client.done:
+	}
+	p.lock.Lock()
+	i := slices.Index(p.queue, ch)
+	if i >= 0 {
+		p.queue = slices.Delete(p.queue, i, i+1)
+	}
+	p.lock.Unlock()
+	if i < 0 {
+		// released at the same time, pass the turn on since this won't run
+		p.releaseNext()
+	}
+	return true, true
+}
+
+// holds reports whether the current pause applies to a command, caller must
+// hold p.lock
+func (p *pauseState) holds(spec *commandSpec, input Value) bool {
+	switch p.mode {
+	case pauseAll:
+		// otherwise nobody could end the pause early
+		return spec == nil || commandFullName(spec, input) != "client|unpause"
+	case pauseWrite:
+		return spec.isWrite()
+	default:
+		return false
+	}
+}
+
+// releaseNext resumes the oldest held command, unless a new pause started
+func (p *pauseState) releaseNext() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.mode != pauseNone || len(p.queue) == 0 {
+		return
+	}
+	close(p.queue[0])
+	p.queue = p.queue[1:]
+}
+
+func (p *pauseState) modeName() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch p.mode {
+	case pauseWrite:
+		return "write"
+	case pauseAll:
+		return "all"
+	default:
+		return "none"
+	}
+}
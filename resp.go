@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
 const (
@@ -14,84 +18,201 @@ const (
 	ARRAY  byte = '*'
 	ERROR  byte = '-'
 	INT    byte = ':'
+
+	// RESP3 types
+	NULL      byte = '_'
+	BOOLEAN   byte = '#'
+	DOUBLE    byte = ','
+	BIGNUM    byte = '('
+	BLOBERROR byte = '!'
+	VERBATIM  byte = '='
+	MAP       byte = '%'
+	SET       byte = '~'
+	ATTRIBUTE byte = '|'
+	PUSH      byte = '>'
 )
 
+// Value is a RESP value. The RESP3 types are kept in the same fields:
+// "map" holds its keys and values alternating in array, "set" and "push"
+// use array, "boolean" uses num (0 or 1), "double" uses double, "bignum"
+// uses str and "verbatim" holds its format (e.g. txt) in str and the text
+// in bulk. RESP2 clients get them downgraded, see Marshal.
 type Value struct {
-	typ   string
-	str   string
-	num   int
-	bulk  string
-	array []Value
+	typ    string
+	str    string
+	num    int
+	bulk   string
+	double float64
+	array  []Value
 }
 
+// Value types of the aggregate RESP types
+var aggregateTypes = map[byte]string{ARRAY: "array", MAP: "map", SET: "set", PUSH: "push", ATTRIBUTE: "attribute"}
+
 type RespParser struct {
 	reader *bufio.Reader
+	// longest bulk string accepted, 0 for no limit
+	maxBulkLen int
+	// applies the tighter limits for clients that haven't authenticated
+	unauthenticated bool
+	// bulk strings are read into buffer, reused from one request to the next
+	buffer []byte
+	// arguments returned by readArgs and where they end in buffer
+	args [][]byte
+	ends []int
+	// array of the last command that borrowed its arguments
+	command []Value
 }
 
+// Marshal encodes v for a RESP2 connection, RESP3 types are sent as their
+// closest RESP2 equivalent: maps and sets become arrays, booleans integers,
+// and doubles, big numbers and verbatim strings bulk strings.
 func (v Value) Marshal() []byte {
+	return v.marshal(2)
+}
+
+// MarshalRESP3 encodes v for a connection that negotiated RESP3 with HELLO
+func (v Value) MarshalRESP3() []byte {
+	return v.marshal(3)
+}
+
+// marshal encodes v for protocol version 2 or 3
+func (v Value) marshal(protocol int) []byte {
+	return v.appendRESP(nil, protocol)
+}
+
+// appendRESP appends v encoded for protocol version 2 or 3 to buffer, so
+// replies can be encoded into a reused buffer without allocating
+func (v Value) appendRESP(buffer []byte, protocol int) []byte {
 	switch v.typ {
 	case "array":
-		return v.MarshalArray()
+		return v.appendAggregate(buffer, ARRAY, len(v.array), protocol)
 	case "bulk":
-		return v.MarshalBulk()
+		return appendBlob(buffer, BULK, v.bulk)
 	case "string":
-		return v.MarshalString()
+		return appendLine(buffer, STRING, v.str)
 	case "integer":
-		return v.MarshalInt()
+		return appendInt(buffer, INT, v.num)
 	case "null":
-		return v.marshalNull()
+		if protocol == 3 {
+			return append(buffer, "_\r\n"...)
+		}
+		return append(buffer, "$-1\r\n"...)
 	case "error":
-		return v.marshalError()
+		return appendLine(buffer, ERROR, v.str)
+	case "map":
+		if protocol == 3 {
+			return v.appendAggregate(buffer, MAP, len(v.array)/2, protocol)
+		}
+		return v.appendAggregate(buffer, ARRAY, len(v.array), protocol)
+	case "set":
+		if protocol == 3 {
+			return v.appendAggregate(buffer, SET, len(v.array), protocol)
+		}
+		return v.appendAggregate(buffer, ARRAY, len(v.array), protocol)
+	case "push":
+		if protocol == 3 {
+			return v.appendAggregate(buffer, PUSH, len(v.array), protocol)
+		}
+		return v.appendAggregate(buffer, ARRAY, len(v.array), protocol)
+	case "boolean":
+		if protocol == 3 {
+			if v.num != 0 {
+				return append(buffer, "#t\r\n"...)
+			}
+			return append(buffer, "#f\r\n"...)
+		}
+		return appendInt(buffer, INT, v.num)
+	case "double":
+		var scratch [32]byte
+		formatted := appendDouble(scratch[:0], v.double)
+		if protocol == 3 {
+			buffer = append(buffer, DOUBLE)
+		} else {
+			buffer = appendInt(buffer, BULK, len(formatted))
+		}
+		buffer = append(buffer, formatted...)
+		return append(buffer, '\r', '\n')
+	case "bignum":
+		if protocol == 3 {
+			return appendLine(buffer, BIGNUM, v.str)
+		}
+		return appendBlob(buffer, BULK, v.str)
+	case "verbatim":
+		if protocol == 3 {
+			buffer = appendInt(buffer, VERBATIM, len(v.str)+1+len(v.bulk))
+			buffer = append(buffer, v.str...)
+			buffer = append(buffer, ':')
+			buffer = append(buffer, v.bulk...)
+			return append(buffer, '\r', '\n')
+		}
+		return appendBlob(buffer, BULK, v.bulk)
 	default:
-		return []byte{}
+		return buffer
 	}
 }
 
-func (v Value) MarshalString() []byte {
-	buffer := []byte{}
-	buffer = append(buffer, STRING)
-	buffer = append(buffer, v.str...)
-	buffer = append(buffer, '\r', '\n')
+func appendLine(buffer []byte, prefix byte, line string) []byte {
+	buffer = append(buffer, prefix)
+	buffer = append(buffer, line...)
+	return append(buffer, '\r', '\n')
+}
+
+// appendInt appends an integer line, also used for length headers
+func appendInt(buffer []byte, prefix byte, n int) []byte {
+	buffer = append(buffer, prefix)
+	buffer = strconv.AppendInt(buffer, int64(n), 10)
+	return append(buffer, '\r', '\n')
+}
+
+func appendBlob(buffer []byte, prefix byte, blob string) []byte {
+	buffer = appendInt(buffer, prefix, len(blob))
+	buffer = append(buffer, blob...)
+	return append(buffer, '\r', '\n')
+}
+
+// appendAggregate appends the header of an array, map, set or push with n
+// elements, followed by every value in v.array
+func (v Value) appendAggregate(buffer []byte, prefix byte, n int, protocol int) []byte {
+	buffer = appendInt(buffer, prefix, n)
+	for _, val := range v.array {
+		buffer = val.appendRESP(buffer, protocol)
+	}
 	return buffer
 }
 
+// appendDouble formats like Redis: the shortest exact representation,
+// inf, -inf or nan
+func appendDouble(buffer []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(buffer, "inf"...)
+	case math.IsInf(f, -1):
+		return append(buffer, "-inf"...)
+	case math.IsNaN(f):
+		return append(buffer, "nan"...)
+	}
+	return strconv.AppendFloat(buffer, f, 'f', -1, 64)
+}
+
+func (v Value) MarshalString() []byte {
+	return appendLine(nil, STRING, v.str)
+}
+
 func (v Value) MarshalInt() []byte {
-	buffer := []byte{}
-	buffer = append(buffer, INT)
-	buffer = append(buffer, strconv.Itoa(v.num)...)
-	buffer = append(buffer, '\r', '\n')
-	return buffer
+	return appendInt(nil, INT, v.num)
 }
 
 func (v Value) MarshalBulk() []byte {
-	buffer := []byte{}
-	buffer = append(buffer, BULK)
-	buffer = append(buffer, strconv.Itoa(len(v.bulk))...)
-	buffer = append(buffer, '\r', '\n')
-	buffer = append(buffer, v.bulk...)
-	buffer = append(buffer, '\r', '\n')
-	return buffer
+	return appendBlob(nil, BULK, v.bulk)
 }
 
 func (v Value) MarshalArray() []byte {
-	buffer := []byte{}
-	buffer = append(buffer, ARRAY)
-	buffer = append(buffer, strconv.Itoa(len(v.array))...)
-	buffer = append(buffer, '\r', '\n')
-
-	// loop through array
-	for _, val := range v.array {
-		buffer = append(buffer, val.Marshal()...)
-	}
-	return buffer
+	return v.appendAggregate(nil, ARRAY, len(v.array), 2)
 }
-func (v Value) marshalError() []byte {
-	var buffer []byte
-	buffer = append(buffer, ERROR)
-	buffer = append(buffer, v.str...)
-	buffer = append(buffer, '\r', '\n')
 
-	return buffer
+func (v Value) marshalError() []byte {
+	return appendLine(nil, ERROR, v.str)
 }
 
 func (v Value) marshalNull() []byte {
@@ -102,19 +223,289 @@ func newRespParser(rd io.Reader) *RespParser {
 	return &RespParser{reader: bufio.NewReader(rd)}
 }
 
+// readLine reads up to the next CRLF, which must be there. Lines are
+// limited to inlineMaxSize so a peer can't make us buffer without end.
+func (r *RespParser) readLine() (string, error) {
+	line, err := r.readLineBytes()
+	return string(line), err
+}
+
+// readLineBytes is readLine without the copy, the line is only valid until
+// the next read
+func (r *RespParser) readLineBytes() ([]byte, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, &protocolError{msg: "expected CRLF line terminator"}
+	}
+	return line[:len(line)-2], nil
+}
+
+// readRawLine reads up to and including the next \n. The line points into
+// the reader's buffer when it fits there, so it's only valid until the next
+// read.
+func (r *RespParser) readRawLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > inlineMaxSize {
+			return nil, &protocolError{msg: "too big inline request"}
+		}
+		if err == nil && line == nil {
+			return chunk, nil
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
 // helper function to read the next integer
 func (r *RespParser) readInt() (int, error) {
-	sizeStr, _ := r.reader.ReadString('\n')
-	trimmed := strings.TrimSuffix(sizeStr, "\r\n")
-	size, err := strconv.Atoi(trimmed)
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(line)
+}
+
+// readLength reads the length of a bulk string or aggregate
+func (r *RespParser) readLength(kind string) (int, error) {
+	line, err := r.readLineBytes()
 	if err != nil {
-		fmt.Println(err)
 		return 0, err
 	}
-	return size, nil
+	n, ok := parseLength(line)
+	if !ok {
+		return 0, &protocolError{msg: "invalid " + kind + " length"}
+	}
+	return n, nil
+}
+
+// parseLength parses a length between -1 and maxMultibulkLen without
+// converting line to a string
+func parseLength(line []byte) (int, bool) {
+	if len(line) == 2 && line[0] == '-' && line[1] == '1' {
+		return -1, true
+	}
+	if len(line) == 0 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range line {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+		if n > maxMultibulkLen {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// readBlob reads a blob of size bytes followed by CRLF
+func (r *RespParser) readBlob(size int) (string, error) {
+	buffer, err := r.appendBlob(r.buffer[:0], size)
+	if err != nil {
+		return "", err
+	}
+	// one that grew for a large bulk isn't held for the lifetime of the
+	// connection
+	if cap(buffer) <= maxRetainedBuffer {
+		r.buffer = buffer
+	}
+	return string(buffer), nil
 }
 
+// appendBlob reads a blob of size bytes followed by CRLF and appends the
+// blob to buffer
+func (r *RespParser) appendBlob(buffer []byte, size int) ([]byte, error) {
+	if r.maxBulkLen > 0 && size > r.maxBulkLen {
+		return nil, &protocolError{msg: "invalid bulk length"}
+	}
+	// grow with the data that actually arrives instead of trusting the
+	// announced size
+	start := len(buffer)
+	for remaining := size + 2; remaining > 0; {
+		n := min(remaining, blobPrealloc)
+		buffer = slices.Grow(buffer, n)
+		if _, err := io.ReadFull(r.reader, buffer[len(buffer):len(buffer)+n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buffer = buffer[:len(buffer)+n]
+		remaining -= n
+	}
+	if buffer[start+size] != '\r' || buffer[start+size+1] != '\n' {
+		return nil, &protocolError{msg: "expected CRLF after bulk string"}
+	}
+	return buffer[:start+size], nil
+}
+
+// longest inline command accepted, like Redis' PROTO_INLINE_MAX_SIZE
+const inlineMaxSize = 64 * 1024
+
+const (
+	// most elements an aggregate may announce, like Redis' INT_MAX check
+	maxMultibulkLen = 1<<31 - 1
+	// elements allocated up front, the rest only as they actually arrive
+	// so a huge announced length can't make us allocate memory
+	multibulkPrealloc = 1024
+	// bulk strings are read in chunks of this size, so memory only grows
+	// as the data arrives
+	blobPrealloc = 64 * 1024
+	// largest read buffer kept between requests
+	maxRetainedBuffer = 64 * 1024
+	// deepest nesting of aggregates readResp accepts
+	maxNestingDepth = 128
+	// limits for clients that haven't authenticated yet, like Redis
+	unauthMultibulkLen = 10
+	unauthBulkLen      = 16 * 1024
+)
+
+// protocolError is a malformed request. The client gets it as an error
+// reply and is disconnected, since the rest of its input can't be trusted.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// readCommand reads the next request of a client: an array of bulk
+// strings, or an inline command as typed in telnet, e.g. PING or
+// SET key "a value". Empty inline lines and empty arrays are skipped.
+// Commands flagged cmdNoRetain get their arguments, and the array holding
+// them, straight from the parser's buffers without copying, so they're only
+// valid until the next read. Every other command gets its own copies.
+func (r *RespParser) readCommand() (Value, error) {
+	args, err := r.readArgs()
+	if err != nil {
+		return Value{}, err
+	}
+	if spec := lookupCommandBytes(args[0]); spec != nil && spec.flags&cmdNoRetain != 0 {
+		command := r.command[:0]
+		for _, arg := range args {
+			command = append(command, Value{typ: "bulk", bulk: unsafe.String(unsafe.SliceData(arg), len(arg))})
+		}
+		r.command = command
+		return Value{typ: "array", array: command}, nil
+	}
+	parsed := Value{typ: "array", array: make([]Value, len(args))}
+	for i, arg := range args {
+		parsed.array[i] = Value{typ: "bulk", bulk: string(arg)}
+	}
+	return parsed, nil
+}
+
+// readArgs is readCommand without the Values: the arguments point into the
+// parser's buffer and are only valid until the next read
+func (r *RespParser) readArgs() ([][]byte, error) {
+	buffer := r.buffer[:0]
+	ends := r.ends[:0]
+	for len(ends) == 0 {
+		b, err := r.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ARRAY {
+			args, err := r.readInline()
+			if err != nil {
+				return nil, err
+			}
+			for _, arg := range args {
+				buffer = append(buffer, arg...)
+				ends = append(ends, len(buffer))
+			}
+			continue
+		}
+
+		r.reader.ReadByte()
+		size, err := r.readLength("multibulk")
+		if err != nil {
+			return nil, err
+		}
+		if r.unauthenticated && size > unauthMultibulkLen {
+			return nil, &protocolError{msg: "unauthenticated multibulk length"}
+		}
+		for i := 0; i < size; i++ {
+			dataType, err := r.reader.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if dataType != BULK {
+				return nil, &protocolError{msg: fmt.Sprintf("expected '$', got '%c'", dataType)}
+			}
+			n, err := r.readLength("bulk")
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || (r.unauthenticated && n > unauthBulkLen) {
+				return nil, &protocolError{msg: "invalid bulk length"}
+			}
+			if buffer, err = r.appendBlob(buffer, n); err != nil {
+				return nil, err
+			}
+			ends = append(ends, len(buffer))
+		}
+	}
+	// slice only once buffer stopped growing
+	args := r.args[:0]
+	start := 0
+	for _, end := range ends {
+		args = append(args, buffer[start:end:end])
+		start = end
+	}
+	r.args, r.ends = args, ends
+	// one that grew for a large request isn't held for the lifetime of the
+	// connection, the arguments keep it alive until they're done with
+	if cap(buffer) <= maxRetainedBuffer {
+		r.buffer = buffer
+	} else {
+		r.buffer = nil
+	}
+	return args, nil
+}
+
+// readInline reads an inline command line and splits it into arguments
+func (r *RespParser) readInline() ([]string, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+	args, err := splitArgs(strings.TrimRight(string(line), "\r\n"))
+	if err != nil {
+		return nil, &protocolError{msg: "unbalanced quotes in request"}
+	}
+	return args, nil
+}
+
+// readResp reads any RESP2 or RESP3 value, e.g. a reply or an AOF entry
 func (r *RespParser) readResp() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *RespParser) readValue(depth int) (Value, error) {
+	if depth > maxNestingDepth {
+		return Value{}, &protocolError{msg: "too deeply nested aggregate"}
+	}
 	// read first byte to get type of data
 	dataType, err := r.reader.ReadByte()
 	if err != nil {
@@ -122,61 +513,123 @@ func (r *RespParser) readResp() (Value, error) {
 	}
 	switch dataType {
 	case STRING:
-		val, err := r.reader.ReadString('\n')
+		line, err := r.readLine()
 		if err != nil {
-			fmt.Println(err)
 			return Value{}, err
 		}
-		trimmed := strings.TrimSuffix(val, "\r\n")
-		return Value{
-			typ: "string",
-			str: trimmed,
-		}, nil
+		return Value{typ: "string", str: line}, nil
+	case ERROR:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "error", str: line}, nil
 	case INT:
-		val, err := r.readInt()
+		line, err := r.readLine()
 		if err != nil {
 			return Value{}, err
 		}
-		return Value{
-			typ: "integer",
-			num: val,
-		}, nil
-
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return Value{}, &protocolError{msg: "invalid integer"}
+		}
+		return Value{typ: "integer", num: n}, nil
 	case BULK:
-		// read the size of string
-		size, err := r.readInt()
+		size, err := r.readLength("bulk")
 		if err != nil {
 			return Value{}, err
 		}
-		// add 2 bytes to consume \r\n at the end of the string
-		buffer := make([]byte, size+2)
-		r.reader.Read(buffer)
-		return Value{
-			typ:  "bulk",
-			bulk: string(buffer[:size]),
-		}, nil
-	case ARRAY:
-		// read array size
-		var parsed Value = Value{}
-		parsed.typ = "array"
-		size, err := r.readInt()
+		// $-1 is a null bulk string
+		if size < 0 {
+			return Value{typ: "null"}, nil
+		}
+		bulk, err := r.readBlob(size)
 		if err != nil {
 			return Value{}, err
 		}
-		parsed.array = make([]Value, 0, size)
+		return Value{typ: "bulk", bulk: bulk}, nil
+	case ARRAY, MAP, SET, PUSH, ATTRIBUTE:
+		size, err := r.readLength("multibulk")
+		if err != nil {
+			return Value{}, err
+		}
+		// *-1 is a null array
+		if size < 0 {
+			return Value{typ: "null"}, nil
+		}
+		if dataType == MAP || dataType == ATTRIBUTE {
+			// keys and values
+			size *= 2
+		}
+		parsed := Value{typ: aggregateTypes[dataType]}
+		parsed.array = make([]Value, 0, min(size, multibulkPrealloc))
 		for i := 0; i < size; i++ {
-			temp, err := r.readResp()
+			temp, err := r.readValue(depth + 1)
 			if err != nil {
 				return Value{}, err
 			}
 			parsed.array = append(parsed.array, temp)
 		}
+		if dataType == ATTRIBUTE {
+			// attributes annotate the reply that follows, which is all we keep
+			return r.readValue(depth)
+		}
+		return parsed, nil
+	case NULL:
+		if _, err := r.readLine(); err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "null"}, nil
+	case BOOLEAN:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		if line != "t" && line != "f" {
+			return Value{}, &protocolError{msg: fmt.Sprintf("invalid boolean %q", line)}
+		}
+		parsed := Value{typ: "boolean"}
+		if line == "t" {
+			parsed.num = 1
+		}
 		return parsed, nil
+	case DOUBLE:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return Value{}, &protocolError{msg: fmt.Sprintf("invalid double %q", line)}
+		}
+		return Value{typ: "double", double: f}, nil
+	case BIGNUM:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "bignum", str: line}, nil
+	case BLOBERROR, VERBATIM:
+		size, err := r.readLength("bulk")
+		if err != nil {
+			return Value{}, err
+		}
+		if size < 0 {
+			return Value{}, &protocolError{msg: "invalid bulk length"}
+		}
+		blob, err := r.readBlob(size)
+		if err != nil {
+			return Value{}, err
+		}
+		if dataType == BLOBERROR {
+			return Value{typ: "error", str: blob}, nil
+		}
+		format, text, ok := strings.Cut(blob, ":")
+		if !ok {
+			return Value{}, &protocolError{msg: fmt.Sprintf("invalid verbatim string %q", blob)}
+		}
+		return Value{typ: "verbatim", str: format, bulk: text}, nil
 
-	// case ":":
-	// 	fmt.Println("Integer")
-	// case "-":
-	// 	fmt.Println("Error")
 	default:
 		return Value{}, fmt.Errorf("unknown RESP type: %c (byte: %d)", dataType, dataType)
 	}
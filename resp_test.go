@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Tests for RespParser.readResp() method
@@ -382,7 +386,7 @@ func TestMarshalNull(t *testing.T) {
 // Edge case tests
 
 func TestUnknownDataType(t *testing.T) {
-	inputUnknown := ":123\r\n"
+	inputUnknown := "?123\r\n"
 	parser := newRespParser(strings.NewReader(inputUnknown))
 	_, err := parser.readResp()
 
@@ -421,3 +425,257 @@ func TestParseAndMarshalSimpleString(t *testing.T) {
 		t.Errorf("Expected %v, got %v", expected, marshalled)
 	}
 }
+
+func TestRESP3RoundTrip(t *testing.T) {
+	values := []Value{
+		{typ: "map", array: []Value{{typ: "bulk", bulk: "a"}, {typ: "integer", num: 1}}},
+		{typ: "set", array: []Value{{typ: "bulk", bulk: "x"}}},
+		{typ: "push", array: []Value{{typ: "bulk", bulk: "message"}}},
+		{typ: "boolean", num: 1},
+		{typ: "boolean"},
+		{typ: "double", double: 3.25},
+		{typ: "bignum", str: "3492890328409238509324850943850943825024385"},
+		{typ: "verbatim", str: "txt", bulk: "Some string"},
+		{typ: "null"},
+	}
+	for _, v := range values {
+		encoded := v.MarshalRESP3()
+		parsed, err := newRespParser(bytes.NewReader(encoded)).readResp()
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", encoded, err)
+			continue
+		}
+		if !bytes.Equal(parsed.MarshalRESP3(), encoded) {
+			t.Errorf("Expected %q to round trip, got %+v", encoded, parsed)
+		}
+	}
+
+	if got := string((Value{typ: "map", array: []Value{{typ: "bulk", bulk: "k"}, {typ: "null"}}}).MarshalRESP3()); got != "%1\r\n$1\r\nk\r\n_\r\n" {
+		t.Errorf("Unexpected map encoding %q", got)
+	}
+	if got := string((Value{typ: "verbatim", str: "txt", bulk: "hi"}).MarshalRESP3()); got != "=6\r\ntxt:hi\r\n" {
+		t.Errorf("Unexpected verbatim encoding %q", got)
+	}
+}
+
+func TestRESP3Downgrade(t *testing.T) {
+	tests := []struct {
+		value Value
+		resp2 string
+	}{
+		{Value{typ: "map", array: []Value{{typ: "bulk", bulk: "k"}, {typ: "integer", num: 1}}}, "*2\r\n$1\r\nk\r\n:1\r\n"},
+		{Value{typ: "set", array: []Value{{typ: "bulk", bulk: "x"}}}, "*1\r\n$1\r\nx\r\n"},
+		{Value{typ: "boolean", num: 1}, ":1\r\n"},
+		{Value{typ: "double", double: 1.5}, "$3\r\n1.5\r\n"},
+		{Value{typ: "double", double: math.Inf(-1)}, "$4\r\n-inf\r\n"},
+		{Value{typ: "bignum", str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n"},
+		{Value{typ: "verbatim", str: "txt", bulk: "hi"}, "$2\r\nhi\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.value.Marshal()); got != tt.resp2 {
+			t.Errorf("Expected %q for %+v, got %q", tt.resp2, tt.value, got)
+		}
+	}
+}
+
+func TestRESP3Attribute(t *testing.T) {
+	// attributes are skipped, the value they annotate is returned
+	parser := newRespParser(strings.NewReader("|1\r\n+ttl\r\n:3600\r\n$3\r\nval\r\n"))
+	result, err := parser.readResp()
+	if err != nil || result.typ != "bulk" || result.bulk != "val" {
+		t.Errorf("Expected the annotated bulk string, got %+v (%v)", result, err)
+	}
+}
+
+func TestReadCommandInline(t *testing.T) {
+	input := "PING\r\n\r\n   \r\nSET key \"a \\\"quoted\\\"\\nvalue\" 'single quoted'\nGET 'it\\'s'\r\n*1\r\n$4\r\nPING\r\n"
+	parser := newRespParser(strings.NewReader(input))
+	want := [][]string{
+		{"PING"},
+		// empty lines are skipped
+		{"SET", "key", "a \"quoted\"\nvalue", "single quoted"},
+		{"GET", "it's"},
+		{"PING"},
+	}
+	for _, args := range want {
+		got, err := parser.readCommand()
+		if err != nil {
+			t.Fatalf("Expected %q, got error %v", args, err)
+		}
+		if len(got.array) != len(args) {
+			t.Fatalf("Expected %q, got %+v", args, got)
+		}
+		for i, arg := range args {
+			if got.array[i].typ != "bulk" || got.array[i].bulk != arg {
+				t.Errorf("Expected argument %d to be %q, got %+v", i, arg, got.array[i])
+			}
+		}
+	}
+}
+
+func TestReadCommandInlineErrors(t *testing.T) {
+	var perr *protocolError
+	parser := newRespParser(strings.NewReader("SET key \"unterminated\r\n"))
+	if _, err := parser.readCommand(); !errors.As(err, &perr) || !strings.Contains(err.Error(), "unbalanced quotes") {
+		t.Errorf("Expected an unbalanced quotes error, got %v", err)
+	}
+	parser = newRespParser(strings.NewReader(strings.Repeat("x", inlineMaxSize+1)))
+	if _, err := parser.readCommand(); !errors.As(err, &perr) || !strings.Contains(err.Error(), "too big inline request") {
+		t.Errorf("Expected a too big inline request error, got %v", err)
+	}
+}
+
+func TestInlineCommandsOverConnection(t *testing.T) {
+	server := newTestServer(t, "")
+	c := dialTestServer(t, server)
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c.conn.Write([]byte("PING\r\nSET greeting \"hello world\"\r\nGET greeting\r\n"))
+	for _, want := range []string{"PONG", "OK", "hello world"} {
+		res, err := c.parser.readResp()
+		if err != nil || (res.str != want && res.bulk != want) {
+			t.Errorf("Expected %q, got %+v (%v)", want, res, err)
+		}
+	}
+
+	c.conn.Write([]byte("GET \"oops\r\n"))
+	if res, err := c.parser.readResp(); err != nil || res.str != "ERR Protocol error: unbalanced quotes in request" {
+		t.Errorf("Expected a protocol error, got %+v (%v)", res, err)
+	}
+	if _, err := c.parser.readResp(); err == nil {
+		t.Errorf("Expected the connection to be closed after a protocol error")
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           string
+		maxBulkLen      int
+		unauthenticated bool
+		err             string
+	}{
+		{"bulk over the limit", "*1\r\n$11\r\nhello world\r\n", 5, false, "invalid bulk length"},
+		{"negative bulk length", "*1\r\n$-2\r\n", 0, false, "invalid bulk length"},
+		{"invalid multibulk length", "*x\r\n", 0, false, "invalid multibulk length"},
+		{"bulk without CRLF", "*1\r\n$4\r\nPINGxx", 0, false, "expected CRLF after bulk string"},
+		{"line without CRLF", "*1\n$4\r\nPING\r\n", 0, false, "expected CRLF line terminator"},
+		{"non-bulk argument", "*1\r\n:1\r\n", 0, false, "expected '$', got ':'"},
+		{"unauthenticated multibulk", "*11\r\n", 0, true, "unauthenticated multibulk length"},
+		{"unauthenticated bulk", "*1\r\n$16385\r\n", 0, true, "invalid bulk length"},
+		{"too long length line", "*" + strings.Repeat("1", inlineMaxSize+1), 0, false, "too big inline request"},
+	}
+	for _, tt := range tests {
+		parser := newRespParser(strings.NewReader(tt.input))
+		parser.maxBulkLen, parser.unauthenticated = tt.maxBulkLen, tt.unauthenticated
+		var perr *protocolError
+		if _, err := parser.readCommand(); !errors.As(err, &perr) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestReadCommandShortReads(t *testing.T) {
+	// announced sizes aren't allocated up front, truncated input is an error
+	for _, input := range []string{"*2147483647\r\n$4\r\nPING\r\n", "*1\r\n$536870911\r\nabc", "*1\r\n$4\r\nPI", "*2\r\n$4\r\nPING\r\n"} {
+		if _, err := newRespParser(strings.NewReader(input)).readCommand(); err != io.ErrUnexpectedEOF {
+			t.Errorf("%q: expected io.ErrUnexpectedEOF, got %v", input, err)
+		}
+	}
+	// empty and null arrays are skipped
+	res, err := newRespParser(strings.NewReader("*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n")).readCommand()
+	if err != nil || len(res.array) != 1 || res.array[0].bulk != "PING" {
+		t.Errorf("Expected PING, got %+v (%v)", res, err)
+	}
+}
+
+func TestReadRespNestingDepth(t *testing.T) {
+	input := strings.Repeat("*1\r\n", maxNestingDepth+2) + ":1\r\n"
+	var perr *protocolError
+	if _, err := newRespParser(strings.NewReader(input)).readResp(); !errors.As(err, &perr) {
+		t.Errorf("Expected deeply nested input to be rejected, got %v", err)
+	}
+	input = strings.Repeat("*1\r\n", maxNestingDepth) + ":1\r\n"
+	if _, err := newRespParser(strings.NewReader(input)).readResp(); err != nil {
+		t.Errorf("Expected nesting up to the limit to parse, got %v", err)
+	}
+}
+
+func TestProtoMaxBulkLen(t *testing.T) {
+	server := newTestServer(t, "proto-max-bulk-len 1048576\n")
+	if res := server.newExecutor().handleCommand(Value{typ: "array"}); res.typ != "error" {
+		t.Errorf("Expected an empty command to be an error, got %v", res)
+	}
+
+	c := dialTestServer(t, server)
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c.conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1048577\r\n"))
+	if res, err := c.parser.readResp(); err != nil || res.str != "ERR Protocol error: invalid bulk length" {
+		t.Errorf("Expected a protocol error, got %+v (%v)", res, err)
+	}
+	if _, err := c.parser.readResp(); err == nil {
+		t.Errorf("Expected the connection to be closed after a protocol error")
+	}
+}
+
+func TestReadCommandReusesBuffer(t *testing.T) {
+	big := strings.Repeat("x", maxRetainedBuffer+1)
+	input := string(command("SET", "key", "value").Marshal()) + "GET key\r\n" + string(command("SET", "big", big).Marshal())
+	parser := newRespParser(strings.NewReader(input))
+	for _, want := range [][]string{{"SET", "key", "value"}, {"GET", "key"}, {"SET", "big", big}} {
+		res, err := parser.readCommand()
+		if err != nil || len(res.array) != len(want) {
+			t.Fatalf("Expected %d arguments, got %+v (%v)", len(want), res, err)
+		}
+		for i := range want {
+			if res.array[i].bulk != want[i] {
+				t.Errorf("Expected argument %d to be %.20q, got %.20q", i, want[i], res.array[i].bulk)
+			}
+		}
+	}
+	// the buffer that grew for the large argument isn't kept
+	if _, err := parser.readCommand(); err != io.EOF || cap(parser.buffer) > maxRetainedBuffer {
+		t.Errorf("Expected EOF and a released buffer, got %v with capacity %d", err, cap(parser.buffer))
+	}
+}
+
+func TestReadCommandCopiesRetainedArguments(t *testing.T) {
+	input := string(command("SET", "key", "value").Marshal()) + string(command("get", "abc").Marshal()) + string(command("GET", "xyz").Marshal())
+	parser := newRespParser(strings.NewReader(input))
+	set, _ := parser.readCommand()
+	get, _ := parser.readCommand()
+	if get.array[1].bulk != "abc" {
+		t.Errorf("Expected GET abc, got %v", get)
+	}
+	parser.readCommand()
+	// SET keeps its arguments, GET's point into the reused buffer
+	if set.array[1].bulk != "key" || set.array[2].bulk != "value" {
+		t.Errorf("Expected SET's arguments to survive the next read, got %v", set)
+	}
+	if get.array[1].bulk != "xyz" {
+		t.Errorf("Expected GET's argument to be overwritten by the next read, got %v", get)
+	}
+}
+
+func TestRESPAllocations(t *testing.T) {
+	parser := newRespParser(&repeatReader{data: command("MGET", "key:1", "key:2", "key:3").Marshal()})
+	if allocs := testing.AllocsPerRun(100, func() { parser.readArgs() }); allocs != 0 {
+		t.Errorf("Expected readArgs not to allocate, got %v allocations", allocs)
+	}
+	// MGET doesn't keep its arguments, so they aren't copied
+	if allocs := testing.AllocsPerRun(100, func() { parser.readCommand() }); allocs != 0 {
+		t.Errorf("Expected readCommand not to allocate for MGET, got %v allocations", allocs)
+	}
+	// the arguments' array and one string per argument
+	parser = newRespParser(&repeatReader{data: command("SET", "key:1", "value").Marshal()})
+	if allocs := testing.AllocsPerRun(100, func() { parser.readCommand() }); allocs != 4 {
+		t.Errorf("Expected readCommand to allocate 4 times for SET, got %v", allocs)
+	}
+	reply := Value{typ: "array", array: []Value{{typ: "bulk", bulk: "value"}, {typ: "null"}, {typ: "integer", num: 42}, {typ: "double", double: 1.5}}}
+	buffer := reply.appendRESP(nil, 3)
+	if allocs := testing.AllocsPerRun(100, func() { buffer = reply.appendRESP(buffer[:0], 3) }); allocs != 0 {
+		t.Errorf("Expected encoding into a reused buffer not to allocate, got %v allocations", allocs)
+	}
+	if got := string(buffer); got != "*4\r\n$5\r\nvalue\r\n_\r\n:42\r\n,1.5\r\n" {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
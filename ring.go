@@ -0,0 +1,50 @@
+package main
+
+// ring keeps the newest items up to a maximum. Once full, a new item
+// overwrites the oldest one in place, so adding never copies the others.
+type ring[T any] struct {
+	// in insertion order starting at head once full
+	items []T
+	// index of the oldest item
+	head int
+	max  int
+}
+
+// ringPrealloc caps the capacity allocated up front, larger rings grow as
+// they fill
+const ringPrealloc = 1024
+
+func (r *ring[T]) len() int {
+	return len(r.items)
+}
+
+// at returns the i-th oldest item
+func (r *ring[T]) at(i int) T {
+	return r.items[(r.head+i)%len(r.items)]
+}
+
+func (r *ring[T]) push(item T) {
+	if len(r.items) < r.max {
+		r.items = append(r.items, item)
+		return
+	}
+	if r.max == 0 {
+		return
+	}
+	r.items[r.head] = item
+	r.head = (r.head + 1) % len(r.items)
+}
+
+// resize changes the maximum, keeping the newest items that fit
+func (r *ring[T]) resize(max int) {
+	keep := min(len(r.items), max)
+	items := make([]T, 0, min(max, ringPrealloc))
+	for i := len(r.items) - keep; i < len(r.items); i++ {
+		items = append(items, r.at(i))
+	}
+	r.items, r.head, r.max = items, 0, max
+}
+
+func (r *ring[T]) reset() {
+	r.items, r.head = make([]T, 0, min(r.max, ringPrealloc)), 0
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server holds the state shared by every connection
+type Server struct {
+	config *Config
+	// file the config was loaded from, rewritten by CONFIG REWRITE
+	configFile string
+	db         *KV
+	aof        *AOF
+	stats      *Stats
+	startTime  time.Time
+	// random identifier of this server instance, reported by INFO
+	runID    string
+	slowlog  *slowLog
+	latency  *latencyMonitor
+	monitors *monitorHub
+	clients  *clientRegistry
+	acl      *aclRegistry
+	acllog   *aclLog
+	audit    *auditLog
+	// proto-max-bulk-len, read by every connection before parsing a request
+	protoMaxBulkLen atomic.Int64
+	// nil unless tls-port is set
+	tls   *tlsState
+	pause pauseState
+}
+
+// newServer creates the keyspace and opens the AOF described by config
+func newServer(config *Config, configFile string) (*Server, error) {
+	kvDatabase := NewKV(config.shards)
+
+	// initialize AOF, encrypted when a key is configured
+	aofKey, err := loadAOFKey(config.aofKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var aof *AOF
+	if config.aofSharded {
+		// one AOF segment per shard, replayed in parallel
+		aof, err = newShardedAOF(config.aofPath(), aofKey, kvDatabase)
+	} else {
+		aof, err = newAOF(config.aofPath(), aofKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy, _ := parseFsyncPolicy(config.appendfsync)
+	aof.setFsyncPolicy(policy)
+
+	latency := newLatencyMonitor(config.latencyMonitor)
+	aof.metrics.latency = latency
+	slowlog := &slowLog{}
+	slowlog.configure(config.slowlogSlower, config.slowlogMaxLen)
+
+	acl := newACLRegistry()
+	if config.aclfile != "" {
+		if err := acl.load(config.aclfile); err != nil {
+			return nil, err
+		}
+	}
+	if config.requirepass != "" {
+		acl.setDefaultPassword(config.requirepass)
+	}
+	acllog := &aclLog{}
+	acllog.configure(config.acllogMaxLen)
+	var serverTLS *tlsState
+	if config.tlsPort != 0 {
+		serverTLS = &tlsState{}
+		if err := serverTLS.reload(config); err != nil {
+			return nil, err
+		}
+	}
+	var audit *auditLog
+	if config.auditLogfile != "" {
+		if audit, err = openAuditLog(config.auditLogfile); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		config:     config,
+		configFile: configFile,
+		db:         kvDatabase,
+		aof:        aof,
+		stats:      newStats(),
+		startTime:  time.Now(),
+		runID:      newRunID(),
+		slowlog:    slowlog,
+		latency:    latency,
+		monitors:   newMonitorHub(),
+		clients:    newClientRegistry(),
+		acl:        acl,
+		acllog:     acllog,
+		audit:      audit,
+		tls:        serverTLS,
+	}
+	s.protoMaxBulkLen.Store(int64(config.protoMaxBulk))
+	return s, nil
+}
+
+func newRunID() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// resetStats clears the counters reported by INFO
+func (s *Server) resetStats() {
+	s.stats.reset()
+	s.db.hits.Store(0)
+	s.db.misses.Store(0)
+	for _, shard := range s.db.shards {
+		shard.stats.reset()
+	}
+}
+
+// cron runs periodic housekeeping until done is closed
+func (s *Server) cron(done <-chan struct{}) {
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+	clientsTicker := time.NewTicker(time.Second)
+	defer clientsTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.stats.sample()
+		case <-clientsTicker.C:
+			s.closeIdleClients()
+		}
+	}
+}
+
+func (s *Server) newExecutor() *Executor {
+	executor := NewExecutor(s.db, s.aof)
+	executor.server = s
+	return executor
+}
+
+// serve accepts connections on every listener until they all fail
+func (s *Server) serve(listeners []net.Listener) {
+	done := make(chan struct{})
+	defer close(done)
+	go s.cron(done)
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.accept(l)
+		}()
+	}
+	wg.Wait()
+}
+
+// accept accepts connections until the listener fails
+func (s *Server) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logWarningf("accept temp error: %v", err)
+				continue
+			}
+
+			logWarningf("accept error: %v", err)
+			return
+		}
+		s.stats.connectionsReceived.Add(1)
+		s.setKeepAlive(conn)
+		go s.handleConnection(conn)
+	}
+}
+
+// replies are written once this much is buffered even if the client still
+// has pipelined commands waiting
+const replyBufferSize = 64 * 1024
+
+// reply buffers that grew past this for a large reply aren't pooled
+const maxPooledReplyBuffer = 4 * replyBufferSize
+
+var replyBuffers = sync.Pool{New: func() any {
+	buffer := make([]byte, 0, replyBufferSize)
+	return &buffer
+}}
+
+// replyWriter batches the replies of a connection. It only holds a buffer
+// from replyBuffers while replies are waiting to be written, so idle
+// connections don't keep one.
+type replyWriter struct {
+	w      io.Writer
+	buffer *[]byte
+}
+
+// write encodes v into the buffer, writing the buffer out once it holds
+// replyBufferSize
+func (rw *replyWriter) write(v Value, protocol int) (int, error) {
+	if rw.buffer == nil {
+		rw.buffer = replyBuffers.Get().(*[]byte)
+	}
+	before := len(*rw.buffer)
+	*rw.buffer = v.appendRESP(*rw.buffer, protocol)
+	n := len(*rw.buffer) - before
+	if len(*rw.buffer) >= replyBufferSize {
+		return n, rw.flush()
+	}
+	return n, nil
+}
+
+// flush writes the buffered replies and gives the buffer back to the pool
+func (rw *replyWriter) flush() error {
+	if rw.buffer == nil {
+		return nil
+	}
+	_, err := rw.w.Write(*rw.buffer)
+	if cap(*rw.buffer) <= maxPooledReplyBuffer {
+		*rw.buffer = (*rw.buffer)[:0]
+		replyBuffers.Put(rw.buffer)
+	}
+	rw.buffer = nil
+	return err
+}
+
+// watchDisconnect notices the peer hanging up while the connection goroutine
+// is blocked and not reading. It only peeks, so nothing is consumed, and the
+// returned func stops the watch before the connection reads again.
+func watchDisconnect(client *Client, reader *bufio.Reader) func() {
+	if reader.Buffered() > 0 {
+		// pipelined commands are waiting, a hang up shows once they're read
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			client.close()
+		}
+	}()
+	return func() {
+		client.conn.SetReadDeadline(time.Now())
+		<-done
+		client.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	s.stats.connectedClients.Add(1)
+	defer s.stats.connectedClients.Add(-1)
+	if reason := s.admit(conn); reason != "" {
+		n, _ := conn.Write(Value{typ: "error", str: reason}.Marshal())
+		s.stats.netOutputBytes.Add(int64(n))
+		return
+	}
+	parser := newRespParser(&countingReader{r: conn, counter: &s.stats.netInputBytes})
+	client := newClient(conn)
+	client.authenticated = s.acl.autoAuthenticates()
+	s.clients.add(client)
+	defer s.clients.remove(client)
+	executor := s.newExecutor()
+	executor.client = client
+	// replies are buffered while the client has more pipelined commands
+	// waiting, so a pipeline is answered with as few writes as possible
+	writer := &replyWriter{w: &countingWriter{w: conn, counter: &s.stats.netOutputBytes}}
+	defer writer.flush()
+	client.onBlock = func() func() {
+		// replies to the commands pipelined before this one shouldn't wait
+		// for it to resume
+		writer.flush()
+		return watchDisconnect(client, parser.reader)
+	}
+	for {
+		parser.maxBulkLen = int(s.protoMaxBulkLen.Load())
+		parser.unauthenticated = !client.authenticated
+		val, err := parser.readCommand()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			var perr *protocolError
+			if errors.As(err, &perr) {
+				writer.write(Value{typ: "error", str: "ERR " + perr.Error()}, client.protocol)
+			}
+			logVerbosef("error reading from client: %v", err)
+			break
+		}
+		client.recordQuery(val, parser.reader.Buffered(), parser.reader.Size())
+		responseVal := executor.handleCommand(val)
+		if responseVal.typ == "quit" {
+			break
+		}
+		if responseVal.typ == "monitor" {
+			client.lock.Lock()
+			client.monitor = true
+			client.lock.Unlock()
+			writer.write(Value{typ: "string", str: "OK"}, client.protocol)
+			if writer.flush() == nil {
+				s.monitor(conn, parser)
+			}
+			break
+		}
+		n, err := writer.write(responseVal, client.protocol)
+		client.recordReply(n)
+		// flush once every pipelined command read so far was answered
+		if err == nil && parser.reader.Buffered() == 0 {
+			err = writer.flush()
+		}
+		if err != nil {
+			logVerbosef("error writing to client: %v", err)
+			break
+		}
+		if client.closeAfterReply.Load() {
+			break
+		}
+	}
+}
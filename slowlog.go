@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limits on what a slow log entry keeps of the command, like Redis
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// slowLog keeps the most recent commands that ran longer than threshold
+type slowLog struct {
+	// microseconds, negative disables the log and 0 records every command
+	threshold atomic.Int64
+	lock      sync.Mutex
+	entries   ring[slowlogEntry]
+	nextID    int64
+}
+
+// configure applies slowlog-log-slower-than and slowlog-max-len
+func (l *slowLog) configure(threshold int, maxLen int) {
+	l.threshold.Store(int64(threshold))
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries.resize(maxLen)
+}
+
+// record adds the command if it ran longer than the threshold
+func (l *slowLog) record(input Value, duration time.Duration, client *Client) {
+	threshold := l.threshold.Load()
+	if threshold < 0 || duration.Microseconds() < threshold {
+		return
+	}
+	entry := slowlogEntry{
+		time:     time.Now(),
+		duration: duration,
+		args:     slowlogArgs(input.array),
+	}
+	if client != nil {
+		entry.addr, entry.name = client.addr, client.clientName()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry.id = l.nextID
+	l.nextID++
+	l.entries.push(entry)
+}
+
+// slowlogArgs copies the arguments, truncating long commands and arguments
+// so a huge MSET doesn't pin its values in memory
+func slowlogArgs(array []Value) []string {
+	argc := min(len(array), slowlogMaxArgc)
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		if i == slowlogMaxArgc-1 && len(array) > slowlogMaxArgc {
+			args = append(args, fmt.Sprintf("... (%d more arguments)", len(array)-slowlogMaxArgc+1))
+			break
+		}
+		arg := array[i].bulk
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		// arguments of cmdNoRetain commands point into the read buffer
+		args = append(args, strings.Clone(arg))
+	}
+	return args
+}
+
+func (e *Executor) handleSlowlogCommand(array []Value) Value {
+	if len(array) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog' command"}
+	}
+	if e.server == nil {
+		return Value{typ: "error", str: "ERR SLOWLOG is not available"}
+	}
+	l := e.server.slowlog
+	switch strings.ToUpper(array[0].bulk) {
+	case "GET":
+		if len(array) > 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog|get' command"}
+		}
+		count := 10
+		if len(array) == 2 {
+			n, err := strconv.Atoi(array[1].bulk)
+			if err != nil || n < -1 {
+				return Value{typ: "error", str: "ERR count should be greater than or equal to -1"}
+			}
+			count = n
+		}
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if count == -1 || count > l.entries.len() {
+			count = l.entries.len()
+		}
+		res := Value{typ: "array", array: make([]Value, 0, count)}
+		// newest first
+		for i := l.entries.len() - 1; i >= l.entries.len()-count; i-- {
+			entry := l.entries.at(i)
+			res.array = append(res.array, entry.marshal())
+		}
+		return res
+	case "LEN":
+		if len(array) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog|len' command"}
+		}
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return Value{typ: "integer", num: l.entries.len()}
+	case "RESET":
+		if len(array) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog|reset' command"}
+		}
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.entries.reset()
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try SLOWLOG HELP.", array[0].bulk)}
+	}
+}
+
+// marshal builds the SLOWLOG GET reply for an entry
+func (entry *slowlogEntry) marshal() Value {
+	args := make([]Value, len(entry.args))
+	for i, arg := range entry.args {
+		args[i] = Value{typ: "bulk", bulk: arg}
+	}
+	return Value{typ: "array", array: []Value{
+		{typ: "integer", num: int(entry.id)},
+		{typ: "integer", num: int(entry.time.Unix())},
+		{typ: "integer", num: int(entry.duration.Microseconds())},
+		{typ: "array", array: args},
+		{typ: "bulk", bulk: entry.addr},
+		{typ: "bulk", bulk: entry.name},
+	}}
+}
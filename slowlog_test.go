@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlowlog(t *testing.T) {
+	server := newTestServer(t, "slowlog-log-slower-than 0\nslowlog-max-len 2\n")
+	executor := server.newExecutor()
+	executor.client = &Client{id: 1, addr: "127.0.0.1:5000", name: "worker", user: "default", authenticated: true}
+
+	executor.handleCommand(command("SET", "a", "1"))
+	executor.handleCommand(command("GET", "a"))
+	executor.handleCommand(command("GET", "b"))
+
+	if res := executor.handleCommand(command("SLOWLOG", "LEN")); res.num != 2 {
+		t.Errorf("Expected the slow log to be trimmed to 2 entries, got %d", res.num)
+	}
+	res := executor.handleCommand(command("SLOWLOG", "GET"))
+	// SLOWLOG LEN was logged too and is the newest entry
+	if len(res.array) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(res.array))
+	}
+	entry := res.array[1].array
+	if entry[0].num != 2 || entry[3].array[0].bulk != "GET" || entry[3].array[1].bulk != "b" {
+		t.Errorf("Expected entry 2 to be GET b, got %v", entry)
+	}
+	if entry[4].bulk != "127.0.0.1:5000" || entry[5].bulk != "worker" {
+		t.Errorf("Expected the client address and name, got %q %q", entry[4].bulk, entry[5].bulk)
+	}
+
+	executor.handleCommand(command("SLOWLOG", "RESET"))
+	executor.handleCommand(command("CONFIG", "SET", "slowlog-log-slower-than", "-1"))
+	executor.handleCommand(command("GET", "a"))
+	if res := executor.handleCommand(command("SLOWLOG", "LEN")); res.num != 1 {
+		// only SLOWLOG RESET itself is recorded, it ran before the log was disabled
+		t.Errorf("Expected a disabled slow log to stop recording, got %d entries", res.num)
+	}
+}
+
+func TestSlowlogCopiesBorrowedArgs(t *testing.T) {
+	server := newTestServer(t, "slowlog-log-slower-than 0\n")
+	client := dialTestServer(t, server)
+	// GET's arguments point into the connection's read buffer, which the
+	// following MGET overwrites
+	client.do(t, "GET", "first")
+	client.do(t, "MGET", "other")
+	res := client.do(t, "SLOWLOG", "GET")
+	if len(res.array) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", res.array)
+	}
+	if args := res.array[1].array[3].array; args[0].bulk != "GET" || args[1].bulk != "first" {
+		t.Errorf("Expected the slow log to keep GET first, got %v", args)
+	}
+}
+
+func TestSlowlogArgsTruncated(t *testing.T) {
+	array := make([]Value, 40)
+	for i := range array {
+		array[i] = Value{typ: "bulk", bulk: "x"}
+	}
+	array[1].bulk = strings.Repeat("v", 200)
+	args := slowlogArgs(array)
+	if len(args) != slowlogMaxArgc {
+		t.Fatalf("Expected %d arguments, got %d", slowlogMaxArgc, len(args))
+	}
+	if args[1] != strings.Repeat("v", 128)+"... (72 more bytes)" {
+		t.Errorf("Expected a truncated argument, got %q", args[1])
+	}
+	if args[slowlogMaxArgc-1] != "... (9 more arguments)" {
+		t.Errorf("Expected the remaining arguments to be summarized, got %q", args[slowlogMaxArgc-1])
+	}
+}
+
+func TestRing(t *testing.T) {
+	var r ring[int]
+	r.resize(3)
+	for i := 1; i <= 5; i++ {
+		r.push(i)
+	}
+	if r.len() != 3 || r.at(0) != 3 || r.at(2) != 5 {
+		t.Errorf("Expected 3, 4, 5, got %v with head %d", r.items, r.head)
+	}
+	// a full ring overwrites in place
+	next := 6
+	if allocs := testing.AllocsPerRun(100, func() { r.push(next); next++ }); allocs != 0 {
+		t.Errorf("Expected pushing to a full ring not to allocate, got %v", allocs)
+	}
+
+	r.resize(2)
+	if r.len() != 2 || r.at(0) != next-2 || r.at(1) != next-1 {
+		t.Errorf("Expected the newest 2 items to be kept, got %v", r.items)
+	}
+	r.resize(0)
+	r.push(7)
+	if r.len() != 0 {
+		t.Errorf("Expected a ring with no room to stay empty, got %v", r.items)
+	}
+}
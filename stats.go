@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many instantaneous ops/sec samples are averaged, taken every statsSampleInterval
+const (
+	statsSamples        = 16
+	statsSampleInterval = 100 * time.Millisecond
+)
+
+// Stats holds the server-wide counters reported by INFO
+type Stats struct {
+	connectionsReceived atomic.Int64
+	connectedClients    atomic.Int64
+	commandsProcessed   atomic.Int64
+	netInputBytes       atomic.Int64
+	netOutputBytes      atomic.Int64
+	// connections refused because of maxclients
+	rejectedConnections atomic.Int64
+
+	// ACL denials by reason, also listed by ACL LOG
+	aclDeniedAuth atomic.Int64
+	aclDeniedCmd  atomic.Int64
+	aclDeniedKey  atomic.Int64
+
+	// per command counters, the map itself is never modified after newStats
+	commands map[*commandSpec]*commandStats
+
+	// error replies by their first word (ERR, WRONGTYPE, ...)
+	errorsLock sync.Mutex
+	errors     map[string]int64
+
+	// ring of ops/sec samples for instantaneous_ops_per_sec
+	samplesLock     sync.Mutex
+	samples         [statsSamples]float64
+	sampleIdx       int
+	lastSampleTime  time.Time
+	lastSampleCount int64
+}
+
+type commandStats struct {
+	calls    atomic.Int64
+	usec     atomic.Int64
+	rejected atomic.Int64
+	failed   atomic.Int64
+	latency  latencyHistogram
+}
+
+func newStats() *Stats {
+	st := &Stats{
+		commands:       make(map[*commandSpec]*commandStats, len(commandTable)),
+		errors:         make(map[string]int64),
+		lastSampleTime: time.Now(),
+	}
+	for _, spec := range commandTable {
+		st.commands[spec] = &commandStats{}
+	}
+	return st
+}
+
+// recordCall accounts for an executed command
+func (st *Stats) recordCall(spec *commandSpec, duration time.Duration, res Value) {
+	if res.typ == "error" {
+		st.recordError(res.str)
+	}
+	cs := st.commands[spec]
+	if cs == nil {
+		return
+	}
+	st.commandsProcessed.Add(1)
+	cs.calls.Add(1)
+	cs.usec.Add(duration.Microseconds())
+	cs.latency.observe(duration)
+	if res.typ == "error" {
+		cs.failed.Add(1)
+	}
+}
+
+// recordRejected accounts for a command refused before it ran
+func (st *Stats) recordRejected(spec *commandSpec, res Value) {
+	st.recordError(res.str)
+	if cs := st.commands[spec]; cs != nil {
+		cs.rejected.Add(1)
+	}
+}
+
+func (st *Stats) recordError(msg string) {
+	prefix, _, _ := strings.Cut(msg, " ")
+	st.errorsLock.Lock()
+	st.errors[prefix]++
+	st.errorsLock.Unlock()
+}
+
+// sample records the ops/sec since the previous sample
+func (st *Stats) sample() {
+	st.samplesLock.Lock()
+	defer st.samplesLock.Unlock()
+	now := time.Now()
+	count := st.commandsProcessed.Load()
+	elapsed := now.Sub(st.lastSampleTime).Seconds()
+	if elapsed > 0 {
+		st.samples[st.sampleIdx] = float64(count-st.lastSampleCount) / elapsed
+		st.sampleIdx = (st.sampleIdx + 1) % statsSamples
+	}
+	st.lastSampleTime = now
+	st.lastSampleCount = count
+}
+
+func (st *Stats) instantaneousOps() int64 {
+	st.samplesLock.Lock()
+	defer st.samplesLock.Unlock()
+	sum := 0.0
+	for _, sample := range st.samples {
+		sum += sample
+	}
+	return int64(sum / statsSamples)
+}
+
+// reset clears the counters, used by CONFIG RESETSTAT. Gauges such as the
+// number of connected clients are kept.
+func (st *Stats) reset() {
+	st.connectionsReceived.Store(0)
+	st.commandsProcessed.Store(0)
+	st.netInputBytes.Store(0)
+	st.netOutputBytes.Store(0)
+	st.rejectedConnections.Store(0)
+	st.aclDeniedAuth.Store(0)
+	st.aclDeniedCmd.Store(0)
+	st.aclDeniedKey.Store(0)
+	for _, cs := range st.commands {
+		cs.calls.Store(0)
+		cs.usec.Store(0)
+		cs.rejected.Store(0)
+		cs.failed.Store(0)
+		cs.latency.reset()
+	}
+	st.errorsLock.Lock()
+	clear(st.errors)
+	st.errorsLock.Unlock()
+	st.samplesLock.Lock()
+	st.samples = [statsSamples]float64{}
+	st.lastSampleCount = 0
+	st.samplesLock.Unlock()
+}
+
+func (st *Stats) writeCommandStats(sb *strings.Builder) {
+	specs := make([]*commandSpec, 0, len(st.commands))
+	for spec, cs := range st.commands {
+		if cs.calls.Load() > 0 || cs.rejected.Load() > 0 {
+			specs = append(specs, spec)
+		}
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+	for _, spec := range specs {
+		cs := st.commands[spec]
+		calls, usec := cs.calls.Load(), cs.usec.Load()
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fmt.Fprintf(sb, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			spec.name, calls, usec, perCall, cs.rejected.Load(), cs.failed.Load())
+	}
+}
+
+func (st *Stats) writeErrorStats(sb *strings.Builder) {
+	st.errorsLock.Lock()
+	defer st.errorsLock.Unlock()
+	prefixes := make([]string, 0, len(st.errors))
+	for prefix := range st.errors {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(sb, "errorstat_%s:count=%d\r\n", prefix, st.errors[prefix])
+	}
+}
+
+// countingReader adds the bytes read from a connection to a counter
+type countingReader struct {
+	r       io.Reader
+	counter *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+// countingWriter adds the bytes written to a connection to a counter
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var tlsVersions = map[string]uint16{
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuthModes = map[string]tls.ClientAuthType{
+	"no":       tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"yes":      tls.RequireAndVerifyClientCert,
+}
+
+// tlsState holds the TLS settings new connections are handshaked with. The
+// settings are swapped on SIGHUP and CONFIG SET so certificates can be
+// renewed without a restart, established connections keep theirs.
+type tlsState struct {
+	config atomic.Pointer[tls.Config]
+}
+
+// loadTLSConfig builds the server TLS configuration from the tls-* options,
+// caller must hold the config lock
+func loadTLSConfig(c *Config) (*tls.Config, error) {
+	if c.tlsCertFile == "" || c.tlsKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[c.tlsMinVersion],
+		ClientAuth:   tlsClientAuthModes[c.tlsAuthClients],
+	}
+	if c.tlsCACertFile != "" {
+		pem, err := os.ReadFile(c.tlsCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the TLS CA certificate: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.tlsCACertFile)
+		}
+	} else if config.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("tls-ca-cert-file must be set to verify client certificates")
+	}
+	if c.tlsCiphers != "" {
+		if config.CipherSuites, err = parseCipherSuites(c.tlsCiphers); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// parseCipherSuites parses a colon separated list of cipher suite names as
+// Go and IANA spell them, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. They
+// only apply to TLS 1.2, TLS 1.3 suites aren't configurable.
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ":") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// reload rebuilds the TLS configuration, keeping the current one on error
+func (t *tlsState) reload(c *Config) error {
+	config, err := loadTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	t.config.Store(config)
+	return nil
+}
+
+// listen opens the TLS listener on addr
+func (t *tlsState) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.config.Load(), nil
+		},
+	}), nil
+}
+
+func applyTLS(s *Server) error {
+	if s.tls == nil {
+		// TLS is disabled, the settings are only checked when tls-port is set
+		return nil
+	}
+	return s.tls.reload(s.config)
+}
+
+// reloadTLS reloads the certificates from disk, on SIGHUP
+func (s *Server) reloadTLS() {
+	if s.tls == nil {
+		return
+	}
+	s.config.lock.RLock()
+	err := s.tls.reload(s.config)
+	s.config.lock.RUnlock()
+	if err != nil {
+		logWarningf("failed to reload TLS certificates, keeping the current ones: %v", err)
+		return
+	}
+	logNoticef("TLS certificates reloaded")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert writes a certificate signed by parent, self-signed CA if
+// parent is nil, to dir
+func newTestCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	tc := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return tc
+}
+
+func (tc *testCert) keyPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key}
+}
+
+// dialTLS connects and returns the server certificate's common name
+func dialTLS(t *testing.T, addr string, ca *testCert, client *testCert) (*testConn, string, error) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.keyPair()}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, "", err
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testConn{conn: conn, parser: &RespParser{reader: bufio.NewReader(conn)}}
+	return c, conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func startTLSServer(t *testing.T, conf string) (*Server, string) {
+	t.Helper()
+	server := newTestServer(t, conf)
+	l, err := server.tls.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.accept(l)
+	return server, l.Addr().String()
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	serverCert := newTestCert(t, dir, "server", ca)
+	clientCert := newTestCert(t, dir, "client", ca)
+	_, addr := startTLSServer(t, "tls-port 6380\ntls-cert-file "+serverCert.certFile+"\ntls-key-file "+serverCert.keyFile+
+		"\ntls-ca-cert-file "+ca.certFile+"\ntls-auth-clients yes\ntls-min-version TLSv1.3\n")
+
+	c, _, err := dialTLS(t, addr, ca, clientCert)
+	if err != nil {
+		t.Fatalf("Failed to connect with a client certificate: %v", err)
+	}
+	if res := c.do(t, "PING"); res.str != "PONG" {
+		t.Errorf("Expected PONG, got %v", res)
+	}
+
+	// with TLS 1.3 the server rejects the missing certificate after the
+	// client's side of the handshake completed
+	if c, _, err := dialTLS(t, addr, ca, nil); err == nil {
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		c.conn.Write(command("PING").Marshal())
+		if _, err := c.parser.readResp(); err == nil {
+			t.Errorf("Expected clients without a certificate to be rejected")
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	first := newTestCert(t, dir, "first", ca)
+	second := newTestCert(t, dir, "second", ca)
+	server, addr := startTLSServer(t, "tls-port 6380\ntls-cert-file "+first.certFile+"\ntls-key-file "+first.keyFile+"\n")
+	executor := server.newExecutor()
+
+	if _, name, err := dialTLS(t, addr, ca, nil); err != nil || name != "first" {
+		t.Fatalf("Expected the first certificate, got %q (%v)", name, err)
+	}
+	res := executor.handleCommand(command("CONFIG", "SET", "tls-cert-file", second.certFile, "tls-key-file", second.keyFile))
+	if res.str != "OK" {
+		t.Fatalf("Expected CONFIG SET to succeed, got %v", res)
+	}
+	if _, name, err := dialTLS(t, addr, ca, nil); err != nil || name != "second" {
+		t.Errorf("Expected the second certificate after CONFIG SET, got %q (%v)", name, err)
+	}
+
+	res = executor.handleCommand(command("CONFIG", "SET", "tls-cert-file", filepath.Join(dir, "missing.crt")))
+	if res.typ != "error" {
+		t.Errorf("Expected a missing certificate to be rejected, got %v", res)
+	}
+	if res := executor.handleCommand(command("CONFIG", "GET", "tls-cert-file")); res.array[1].bulk != second.certFile {
+		t.Errorf("Expected the failed CONFIG SET to be rolled back, got %v", res)
+	}
+
+	// SIGHUP reloads the files in place
+	os.Rename(first.certFile, second.certFile)
+	os.Rename(first.keyFile, second.keyFile)
+	server.reloadTLS()
+	if _, name, err := dialTLS(t, addr, ca, nil); err != nil || name != "first" {
+		t.Errorf("Expected the renewed certificate after a reload, got %q (%v)", name, err)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(ids) != 2 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Expected two suites, got %v (%v)", ids, err)
+	}
+	if _, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil || !strings.Contains(err.Error(), "TLS_RSA_WITH_RC4_128_SHA") {
+		t.Errorf("Expected insecure suites to be rejected, got %v", err)
+	}
+}